@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes data to name by way of a temporary file in the same
+// directory that is then renamed over it, so a run that is killed part way
+// never leaves name empty or half written. With fsync the temporary file is
+// flushed to disk before the rename, which network filesystems need for the
+// write to survive a crash. The temporary file is removed if anything fails.
+func writeFileAtomic(name string, data []byte, perm os.FileMode, fsync bool) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if fsync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"text/template"
+)
+
+// tempFiles lists the temporary files writeFileAtomic has left in dir.
+func tempFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, ".*.tmp*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+// TestUpdateTemplateFailure checks that a Dockerfile.tmpl failing part way
+// through leaves the Dockerfile there was and no temporary file.
+func TestUpdateTemplateFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "2.11")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const original = "FROM scratch\nENV CROWD_VERSION 2.11.0\n"
+	name := filepath.Join(dir, "Dockerfile")
+	if err := os.WriteFile(name, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := tmpl
+	defer func() { tmpl = saved }()
+	tmpl = template.Must(template.New("Dockerfile.tmpl").Parse("FROM scratch\nENV CROWD_VERSION {{.Version}}\n{{.NoSuchField}}\n"))
+
+	cfg := defaultConfig()
+	cfg.NoEntrypoint = true
+	e := planEntry{Dir: dir, Key: "2.11", Action: actionUpdate, Package: Package{
+		Version: "2.11.1",
+		ZipURL:  "https://example.com/atlassian-crowd-2.11.1.tar.gz",
+	}}
+	if _, err := update(e, cfg); err == nil {
+		t.Fatal("update succeeded with a failing template")
+	}
+
+	have, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(have) != original {
+		t.Errorf("Dockerfile changed to:\n%s", have)
+	}
+	if left := tempFiles(t, dir); len(left) > 0 {
+		t.Errorf("temporary files left behind: %v", left)
+	}
+}
+
+// TestWriteFileAtomicFailure checks that a write that fails at the rename,
+// here because a directory is in the way, removes its temporary file.
+func TestWriteFileAtomicFailure(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "Dockerfile")
+	if err := os.Mkdir(name, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(name, "keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(name, []byte("FROM scratch\n"), 0644, true); err == nil {
+		t.Fatal("writeFileAtomic replaced a directory")
+	}
+	if left := tempFiles(t, dir); len(left) > 0 {
+		t.Errorf("temporary files left behind: %v", left)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// generatedFiles lists the files update writes into each version directory,
+// or into each variant subdirectory when there are variants.
+func generatedFiles(cfg Config) []string {
+	return []string{"Dockerfile", cfg.EntrypointDst, "metadata.json", "args.env"}
+}
+
+// audit lists every file in the version directories that update didn't
+// generate, such as old Dockerfile.bak files or leftover scripts. With
+// -prune-orphans they are removed as well. Held directories are left alone.
+func audit(versionDirs []string, cfg Config) error {
+	var orphans []string
+	for _, dir := range versionDirs {
+		if !isVersionDir(dir, cfg) || contains(cfg.Hold, dir) {
+			continue
+		}
+		found, err := orphansIn(dir, cfg)
+		if err != nil {
+			return fmt.Errorf("error auditing %s: %w", dir, err)
+		}
+		orphans = append(orphans, found...)
+	}
+	sort.Strings(orphans)
+
+	for _, name := range orphans {
+		if !cfg.PruneOrphans {
+			infof("orphan %s", filepath.ToSlash(name))
+			continue
+		}
+		if err := os.RemoveAll(name); err != nil {
+			return fmt.Errorf("error removing %s: %w", name, err)
+		}
+		infof("removed %s", filepath.ToSlash(name))
+	}
+	return nil
+}
+
+// orphansIn returns the paths of the entries in the version directory dir
+// that aren't generated, other than its overridesFile and the files a
+// -scaffold directory is populated with. When there are variants only their
+// subdirectories belong in dir, and those are checked in turn.
+func orphansIn(dir string, cfg Config) ([]string, error) {
+	want := generatedFiles(cfg)
+	if len(cfg.Variants) > 0 {
+		want = nil
+		for _, v := range cfg.Variants {
+			want = append(want, v.Name)
+		}
+	}
+	scaffolded, err := scaffoldFiles(cfg.ScaffoldTemplates)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		if entry.Name() == overridesFile || entry.Name() == dirTemplateFile || contains(scaffolded, entry.Name()) {
+			continue
+		}
+		if !contains(want, entry.Name()) {
+			orphans = append(orphans, name)
+			continue
+		}
+		if len(cfg.Variants) == 0 {
+			continue
+		}
+		if !entry.IsDir() {
+			orphans = append(orphans, name)
+			continue
+		}
+		found, err := orphansIn(name, Config{EntrypointDst: cfg.EntrypointDst})
+		if err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, found...)
+	}
+	return orphans, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+var chownWarning sync.Once
+
+// errChown is returned, along with the underlying error, when a generated
+// file can't be given the -uid and -gid.
+var errChown = errors.New("can't change the owner")
+
+// chownGenerated gives a generated file the owner and group set with -uid and
+// -gid. Either left at -1 is unchanged. Platforms without unix file ownership
+// leave it alone, warning once that -uid and -gid are ignored.
+func chownGenerated(name string, cfg Config) error {
+	if cfg.UID < 0 && cfg.GID < 0 {
+		return nil
+	}
+	switch runtime.GOOS {
+	case "windows", "plan9", "js", "wasip1":
+		chownWarning.Do(func() {
+			warnf("chown_unsupported", "-uid and -gid are not supported on this platform; leaving file ownership alone")
+		})
+		return nil
+	}
+	if err := os.Lchown(name, cfg.UID, cfg.GID); err != nil {
+		return fmt.Errorf("%w of %s: %w", errChown, name, err)
+	}
+	return nil
+}
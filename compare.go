@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+)
+
+// snapshotChange is one difference -compare-with found between the versions
+// resolved from two snapshots of the feeds.
+type snapshotChange struct {
+	Key             string  `json:"key"`
+	Change          string  `json:"change"`
+	PreviousVersion Version `json:"previousVersion,omitempty"`
+	Version         Version `json:"version,omitempty"`
+	PreviousURL     string  `json:"previousUrl,omitempty"`
+	URL             string  `json:"url,omitempty"`
+}
+
+// compareSnapshots resolves the feeds as saved in the snapshots from and to
+// and prints what changed for each version key: versions that were added or
+// removed, those that moved to a newer release, and those whose release is
+// now downloaded from another URL. Nothing is fetched over the network and
+// nothing is written.
+func compareSnapshots(ctx context.Context, w io.Writer, from, to string, cfg Config) error {
+	before, err := resolveSnapshot(ctx, from, cfg)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", from, err)
+	}
+	after, err := resolveSnapshot(ctx, to, cfg)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", to, err)
+	}
+
+	changes := []snapshotChange{}
+	for key, p := range after {
+		c := snapshotChange{Key: key, Version: p.Version, URL: p.ZipURL}
+		q, ok := before[key]
+		switch {
+		case !ok:
+			c.Change = "added"
+		case q.Version != p.Version:
+			c.Change = "updated"
+		case q.ZipURL != p.ZipURL:
+			c.Change = "moved"
+		default:
+			continue
+		}
+		if ok {
+			c.PreviousVersion, c.PreviousURL = q.Version, q.ZipURL
+		}
+		changes = append(changes, c)
+	}
+	for key, q := range before {
+		if _, ok := after[key]; !ok {
+			changes = append(changes, snapshotChange{Key: key, Change: "removed", PreviousVersion: q.Version, PreviousURL: q.ZipURL})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return Version(changes[i].Key).Compare(Version(changes[j].Key)) < 0
+	})
+
+	if cfg.Output == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(changes)
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, c := range changes {
+		switch c.Change {
+		case "added":
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Change, c.Key, c.Version, c.URL)
+		case "removed":
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Change, c.Key, c.PreviousVersion, c.PreviousURL)
+		case "updated":
+			fmt.Fprintf(tw, "%s\t%s\t%s -> %s\t%s\n", c.Change, c.Key, c.PreviousVersion, c.Version, c.URL)
+		case "moved":
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s -> %s\n", c.Change, c.Key, c.Version, c.PreviousURL, c.URL)
+		}
+	}
+	return tw.Flush()
+}
+
+// resolveSnapshot resolves the versions in a snapshot of the feeds: a
+// directory used as a -cache-dir, read as -offline would, or a single saved
+// feed file, read as the current feed.
+func resolveSnapshot(ctx context.Context, snapshot string, cfg Config) (map[string]Package, error) {
+	info, err := os.Stat(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Offline = true
+	cfg.CacheDir = snapshot
+	feeds := cfg.feeds()
+	if !info.IsDir() {
+		cfg.CacheDir = ""
+		feeds = []feed{{channelCurrent, []string{snapshot}}}
+	}
+	f := newFetcher(cfg)
+	fetched, err := f.readFeeds(ctx, feeds)
+	if err != nil {
+		return nil, err
+	}
+	err = parseFeeds(fetched, func(p Package) bool {
+		return f.skipReason(p) == ""
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f.resolve(fetched), nil
+}
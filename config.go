@@ -0,0 +1,547 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings for a run. Values come from the defaults, then an
+// optional JSON config file given with -config, and finally any flags set on
+// the command line, each overriding the last.
+type Config struct {
+	CurrentFeed            URLList           `json:"currentFeed"`
+	ArchiveFeed            URLList           `json:"archiveFeed"`
+	EAPFeed                URLList           `json:"eapFeed"`
+	PruneBackups           bool              `json:"pruneBackups"`
+	Metadata               bool              `json:"metadata"`
+	Verbose                bool              `json:"verbose"`
+	Timeout                Duration          `json:"timeout"`
+	Check                  bool              `json:"check"`
+	CacheDir               string            `json:"cacheDir"`
+	Offline                bool              `json:"offline"`
+	FeedTimezone           string            `json:"feedTimezone"`
+	Scaffold               string            `json:"scaffold"`
+	ScaffoldTemplates      string            `json:"scaffoldTemplates"`
+	LogJSON                bool              `json:"logJson"`
+	ParallelFeeds          bool              `json:"parallelFeeds"`
+	Concurrency            int               `json:"concurrency"`
+	NoEntrypoint           bool              `json:"noEntrypoint"`
+	Hold                   []string          `json:"hold"`
+	Make                   bool              `json:"make"`
+	Validate               bool              `json:"validate"`
+	PreserveEntrypointMode bool              `json:"preserveEntrypointMode"`
+	DryRun                 bool              `json:"dryRun"`
+	CreateNew              bool              `json:"createNew"`
+	Prune                  bool              `json:"prune"`
+	MinVersion             Version           `json:"minVersion"`
+	Checksum               bool              `json:"checksum"`
+	VersionPattern         string            `json:"versionPattern"`
+	SyncEntrypoint         bool              `json:"syncEntrypoint"`
+	TagPrefix              string            `json:"tagPrefix"`
+	PatchInTag             bool              `json:"patchInTag"`
+	LatestPerMajor         bool              `json:"selectLatestPerMajor"`
+	Explain                string            `json:"explain"`
+	UID                    int               `json:"uid"`
+	GID                    int               `json:"gid"`
+	ContinueOnError        bool              `json:"continueOnError"`
+	TemplateData           map[string]string `json:"templateData"`
+	SourceDate             Timestamp         `json:"sourceDate"`
+	RegistryCheck          string            `json:"registryCheck"`
+	NoLatest               bool              `json:"noLatest"`
+	IncludeWar             bool              `json:"includeWar"`
+	UserAgent              string            `json:"userAgent"`
+	RegistryProvenance     bool              `json:"registryProvenance"`
+	Strict                 bool              `json:"strict"`
+	KeepArchiveOnly        bool              `json:"keepArchiveOnly"`
+	Fsync                  bool              `json:"fsync"`
+	Audit                  bool              `json:"audit"`
+	PruneOrphans           bool              `json:"pruneOrphans"`
+	ValidateTemplate       bool              `json:"validateTemplate"`
+	ListChanged            bool              `json:"listChanged"`
+	EntrypointSrc          string            `json:"entrypointSrc"`
+	EntrypointDst          string            `json:"entrypointDst"`
+	PrintConfig            bool              `json:"-"`
+	RejectEAP              bool              `json:"rejectEap"`
+	BuildArgs              bool              `json:"buildArgs"`
+	GroupByPatch           bool              `json:"groupByPatch"`
+	Coverage               bool              `json:"coverage"`
+	SinceVersion           Version           `json:"sinceVersion"`
+	OutDir                 string            `json:"outDir"`
+	PostHook               string            `json:"postHook"`
+	SeparateEditions       bool              `json:"separateEditions"`
+	NewerThanFile          string            `json:"newerThanFile"`
+	Force                  bool              `json:"force"`
+	Output                 string            `json:"output"`
+	GroupDepth             int               `json:"groupDepth"`
+	DownloadConcurrency    int               `json:"downloadConcurrency"`
+	OnlyExisting           bool              `json:"onlyExisting"`
+	FetchOnly              bool              `json:"fetchOnly"`
+	Lock                   string            `json:"lock"`
+	UpdateLock             bool              `json:"updateLock"`
+	RetryBudget            int               `json:"retryBudget"`
+	CompareWith            []string          `json:"compareWith"`
+	EAPTag                 string            `json:"eapTag"`
+	MaxAge                 Duration          `json:"maxAge"`
+	MultiStage             string            `json:"multiStage"`
+	NoEAPInDirectories     bool              `json:"noEapInDirectories"`
+	DownloadTimeout        Duration          `json:"downloadTimeout"`
+	ShellVersions          string            `json:"shellVersions"`
+	URLRewrite             map[string]string `json:"urlRewrite"`
+	Sort                   string            `json:"sort"`
+	StabilityWindow        Duration          `json:"stabilityWindow"`
+	Quiet                  bool              `json:"quiet"`
+
+	// These can only be set in the config file. BaseImage and JDK are for
+	// any variant that doesn't set its own, or the image when there are no
+	// variants. Directories maps directory names to the versionRule each is
+	// resolved by, in place of the version taken from its name.
+	Variants    []Variant              `json:"variants"`
+	JDKMap      map[string][]string    `json:"jdkMap"`
+	BaseImage   string                 `json:"baseImage"`
+	JDK         string                 `json:"jdk"`
+	Directories map[string]versionRule `json:"directories"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		CurrentFeed:         URLList{currentUrl},
+		ArchiveFeed:         URLList{archiveUrl},
+		EAPFeed:             URLList{eapUrl},
+		FeedTimezone:        "UTC",
+		ScaffoldTemplates:   "templates",
+		Concurrency:         1,
+		VersionPattern:      defaultVersionPattern,
+		UID:                 -1,
+		GID:                 -1,
+		UserAgent:           defaultUserAgent(),
+		EntrypointSrc:       "docker-entrypoint.sh",
+		EntrypointDst:       "docker-entrypoint.sh",
+		Output:              "text",
+		GroupDepth:          2,
+		DownloadConcurrency: 2,
+		RetryBudget:         4,
+		DownloadTimeout:     Duration(5 * time.Minute),
+		Sort:                "asc",
+	}
+}
+
+// defaultUserAgent identifies this tool, and its version when it was built
+// from a tagged module, to the sites it makes requests to.
+func defaultUserAgent() string {
+	ua := "docker-atlassian-crowd-updater"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		ua += "/" + info.Main.Version
+	}
+	return ua
+}
+
+// conflictingFlags are the pairs of flags that contradict each other, which
+// parseConfig rejects before anything is done. -dry-run and -check, and so
+// -list-changed, promise to write nothing, so they rule out each other and
+// the modes that write or remove files, and -fetch-only has nothing to fetch
+// with -offline. The -list-changed pairs come before -check's, which it
+// implies, so that it is the flag named.
+var conflictingFlags = [][2]string{
+	{"dry-run", "list-changed"},
+	{"dry-run", "check"},
+	{"dry-run", "update-lock"},
+	{"dry-run", "fetch-only"},
+	{"dry-run", "shell-versions"},
+	{"dry-run", "scaffold"},
+	{"dry-run", "sync-entrypoint"},
+	{"dry-run", "prune-orphans"},
+	{"list-changed", "update-lock"},
+	{"list-changed", "fetch-only"},
+	{"list-changed", "shell-versions"},
+	{"list-changed", "scaffold"},
+	{"list-changed", "sync-entrypoint"},
+	{"list-changed", "prune-orphans"},
+	{"check", "update-lock"},
+	{"check", "fetch-only"},
+	{"check", "shell-versions"},
+	{"check", "scaffold"},
+	{"check", "sync-entrypoint"},
+	{"check", "prune-orphans"},
+	{"fetch-only", "offline"},
+}
+
+// flagSet reports whether each of the flags in conflictingFlags is set.
+var flagSet = map[string]func(Config) bool{
+	"dry-run":         func(cfg Config) bool { return cfg.DryRun },
+	"check":           func(cfg Config) bool { return cfg.Check },
+	"list-changed":    func(cfg Config) bool { return cfg.ListChanged },
+	"update-lock":     func(cfg Config) bool { return cfg.UpdateLock },
+	"fetch-only":      func(cfg Config) bool { return cfg.FetchOnly },
+	"shell-versions":  func(cfg Config) bool { return cfg.ShellVersions != "" },
+	"scaffold":        func(cfg Config) bool { return cfg.Scaffold != "" },
+	"sync-entrypoint": func(cfg Config) bool { return cfg.SyncEntrypoint },
+	"prune-orphans":   func(cfg Config) bool { return cfg.PruneOrphans },
+	"offline":         func(cfg Config) bool { return cfg.Offline },
+}
+
+func newFlagSet(cfg *Config, configFile *string) *flag.FlagSet {
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s:\n", fs.Name())
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "\nThese flags can't be used together:\n")
+		for _, c := range conflictingFlags {
+			fmt.Fprintf(fs.Output(), "  -%s with -%s\n", c[0], c[1])
+		}
+	}
+	fs.StringVar(configFile, "config", "", "read settings from a JSON config `file`; flags override its values")
+	fs.Var(&stringList{list: (*[]string)(&cfg.CurrentFeed)}, "current-feed", "`url` of the current releases feed; may be repeated for a feed split across several URLs")
+	fs.Var(&stringList{list: (*[]string)(&cfg.ArchiveFeed)}, "archive-feed", "`url` of the archived releases feed; may be repeated")
+	fs.Var(&stringList{list: (*[]string)(&cfg.EAPFeed)}, "eap-feed", "`url` of the EAP releases feed; may be repeated")
+	fs.BoolVar(&cfg.PruneBackups, "prune-backups", cfg.PruneBackups, "remove any Dockerfile.bak files found in version directories")
+	fs.BoolVar(&cfg.Metadata, "metadata", cfg.Metadata, "write a metadata.json describing the resolved package into each version directory")
+	fs.BoolVar(&cfg.Verbose, "verbose", cfg.Verbose, "print debug output")
+	fs.BoolVar(&cfg.LogJSON, "log-json", cfg.LogJSON, "write debug output and warnings to stderr as JSON")
+	fs.Var(&cfg.Timeout, "timeout", "stop the whole run after this `duration`, exiting with status 3 (default no limit)")
+	fs.BoolVar(&cfg.Check, "check", cfg.Check, "write nothing; list the version directories that are out of date and exit non-zero if there are any (with -offline this suits a pre-commit hook)")
+	fs.StringVar(&cfg.CacheDir, "cache-dir", cfg.CacheDir, "save a copy of each feed in `dir`")
+	fs.BoolVar(&cfg.Offline, "offline", cfg.Offline, "read the feeds from -cache-dir instead of the network")
+	fs.StringVar(&cfg.FeedTimezone, "feed-timezone", cfg.FeedTimezone, "IANA time zone `name` that the dates in the feeds are read in")
+	fs.StringVar(&cfg.Scaffold, "scaffold", cfg.Scaffold, "create the directory for major.minor `version` from -scaffold-templates and exit")
+	fs.StringVar(&cfg.ScaffoldTemplates, "scaffold-templates", cfg.ScaffoldTemplates, "`dir` of files to populate a -scaffold directory with; .tmpl files are executed with the package")
+	fs.BoolVar(&cfg.ParallelFeeds, "parallel-feeds", cfg.ParallelFeeds, "fetch the feeds concurrently instead of one at a time")
+	fs.IntVar(&cfg.Concurrency, "concurrency", cfg.Concurrency, "number of version directories to update at once")
+	fs.BoolVar(&cfg.NoEntrypoint, "no-entrypoint", cfg.NoEntrypoint, "only generate Dockerfiles, leaving each directory's docker-entrypoint.sh alone; -scaffold still writes whatever its templates contain")
+	fs.Var(&stringList{list: &cfg.Hold}, "hold", "`version` directory to leave exactly as it is, even if it is missing from the feeds; may be repeated")
+	fs.BoolVar(&cfg.Make, "make", cfg.Make, "regenerate the top-level Makefile from Makefile.tmpl with a docker build target per version")
+	fs.BoolVar(&cfg.Validate, "validate", cfg.Validate, "check the template, entrypoint, feeds and working directory are usable, then exit without writing anything")
+	fs.BoolVar(&cfg.PreserveEntrypointMode, "preserve-entrypoint-mode", cfg.PreserveEntrypointMode, "give copied entrypoints the permissions of the source instead of 0764")
+	fs.BoolVar(&cfg.DryRun, "dry-run", cfg.DryRun, "print what would be created, updated, skipped and pruned without changing anything")
+	fs.BoolVar(&cfg.CreateNew, "create-new", cfg.CreateNew, "create directories for resolved versions newer than the highest existing one")
+	fs.BoolVar(&cfg.Prune, "prune", cfg.Prune, "remove version directories that are no longer in any feed")
+	fs.StringVar((*string)(&cfg.MinVersion), "min-version", string(cfg.MinVersion), "ignore resolved versions older than `version`")
+	fs.BoolVar(&cfg.Checksum, "checksum", cfg.Checksum, "download each tarball and verify its SHA-256 in the Dockerfile")
+	fs.StringVar(&cfg.VersionPattern, "version-pattern", cfg.VersionPattern, "`regexp` matching version directory names; its first capture group is the major.minor, or the full version with -group-by-patch")
+	fs.BoolVar(&cfg.SyncEntrypoint, "sync-entrypoint", cfg.SyncEntrypoint, "only copy docker-entrypoint.sh into every version directory, without reading the feeds")
+	fs.StringVar(&cfg.TagPrefix, "tag-prefix", cfg.TagPrefix, "`prefix`, such as \"mycorp/crowd:\", for the generated image tags")
+	fs.BoolVar(&cfg.PatchInTag, "patch-in-tag", cfg.PatchInTag, "also tag each image with its full version, such as 2.11.1")
+	fs.BoolVar(&cfg.LatestPerMajor, "select-latest-per-major", cfg.LatestPerMajor, "also tag the highest version of each major with the major, such as 2")
+	fs.StringVar(&cfg.Explain, "explain", cfg.Explain, "print how the feeds resolve major.minor `version` and exit without writing anything")
+	fs.IntVar(&cfg.UID, "uid", cfg.UID, "on unix, chown the generated files to user `id`; -1 leaves it alone")
+	fs.IntVar(&cfg.GID, "gid", cfg.GID, "on unix, chown the generated files to group `id`; -1 leaves it alone")
+	fs.BoolVar(&cfg.ContinueOnError, "continue-on-error", cfg.ContinueOnError, "carry on with the other version directories when one fails, listing every failure at the end")
+	fs.Var(&keyValues{m: &cfg.TemplateData}, "template-data", "`key=value` made available to the templates as .Extra.key; may be repeated")
+	fs.Var(&cfg.SourceDate, "source-date", "build `date` for the generated files, as an RFC 3339 time or Unix seconds (default $SOURCE_DATE_EPOCH, else each package's release date)")
+	fs.StringVar(&cfg.RegistryCheck, "registry-check", cfg.RegistryCheck, "list which of the planned tags are already published to the registry repository at `url`, such as https://registry.example.com/v2/mycorp/crowd, and exit without writing anything")
+	fs.BoolVar(&cfg.NoLatest, "no-latest", cfg.NoLatest, "never mark a version as latest, leaving the latest tag to a separate promotion step")
+	fs.BoolVar(&cfg.IncludeWar, "include-war", cfg.IncludeWar, "keep war builds, preferring them over the standalone tarball of the same version; templates can check .Artifact")
+	fs.StringVar(&cfg.UserAgent, "user-agent", cfg.UserAgent, "`value` of the User-Agent header sent with every request")
+	fs.BoolVar(&cfg.RegistryProvenance, "registry-provenance", cfg.RegistryProvenance, "with -registry-check, also report published tags whose image labels show a different tarball than the one resolved now")
+	fs.BoolVar(&cfg.Strict, "strict", cfg.Strict, "fail on suspicious feed entries, such as a release date in the future, or on any feed that can't be read, instead of warning")
+	fs.BoolVar(&cfg.KeepArchiveOnly, "keep-archive-only", cfg.KeepArchiveOnly, "only use releases that have aged into the archive feed, ignoring the current and EAP feeds; nothing is tagged latest")
+	fs.BoolVar(&cfg.Fsync, "fsync", cfg.Fsync, "flush each generated file to disk before renaming it into place; slower, but safe on flaky storage")
+	fs.BoolVar(&cfg.Audit, "audit", cfg.Audit, "list the files in version directories that aren't generated, without reading the feeds, and exit")
+	fs.BoolVar(&cfg.PruneOrphans, "prune-orphans", cfg.PruneOrphans, "with -audit, remove the files it lists")
+	fs.BoolVar(&cfg.ValidateTemplate, "validate-template", cfg.ValidateTemplate, "render Dockerfile.tmpl with sample packages, reporting any errors, then exit without writing anything")
+	fs.BoolVar(&cfg.ListChanged, "list-changed", cfg.ListChanged, "like -check, but only print the version directories that would change, one per line, and exit zero")
+	fs.StringVar(&cfg.EntrypointSrc, "entrypoint-src", cfg.EntrypointSrc, "`path` of the entrypoint script copied into every version directory")
+	fs.StringVar(&cfg.EntrypointDst, "entrypoint-dst", cfg.EntrypointDst, "`name` the entrypoint script is given in each version directory; templates can use it as .Entrypoint")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", cfg.PrintConfig, "print the settings in effect after the defaults, -config file and flags as JSON, with any credentials redacted, and exit")
+	fs.BoolVar(&cfg.RejectEAP, "reject-eap", cfg.RejectEAP, "fail for an existing version directory that only an EAP release satisfies, instead of using it with a warning")
+	fs.BoolVar(&cfg.BuildArgs, "build-args", cfg.BuildArgs, "write an args.env of KEY=VALUE lines with the resolved version, URL, checksum and release date into each version directory, for docker build --build-arg")
+	fs.BoolVar(&cfg.GroupByPatch, "group-by-patch", cfg.GroupByPatch, "keep a version directory per full version, such as 5.1.3, instead of per major.minor")
+	fs.BoolVar(&cfg.Coverage, "coverage", cfg.Coverage, "print how many versions each feed channel has and which resolved versions only the archive or EAP feed has, and exit without writing anything")
+	fs.StringVar((*string)(&cfg.SinceVersion), "since-version", string(cfg.SinceVersion), "leave version directories older than `version` alone this run, without pruning them")
+	fs.StringVar(&cfg.OutDir, "out-dir", cfg.OutDir, "write the generated files to a mirror of the version directories under `dir` instead of in place, leaving the repository untouched")
+	fs.StringVar(&cfg.PostHook, "post-hook", cfg.PostHook, "run `command` with each updated directory as its argument, failing the directory if it exits non-zero")
+	fs.BoolVar(&cfg.SeparateEditions, "separate-editions", cfg.SeparateEditions, "resolve Data Center builds into their own version directories, such as 5.1-dc, instead of competing with the standard build of the same version")
+	fs.StringVar(&cfg.NewerThanFile, "newer-than-file", cfg.NewerThanFile, "record a hash of the feeds in `file` after a successful run, and exit early without changing anything while they still match it")
+	fs.BoolVar(&cfg.Force, "force", cfg.Force, "run even when -newer-than-file shows the feeds are unchanged, or when the working directory doesn't look like the repository root")
+	fs.StringVar(&cfg.Output, "output", cfg.Output, "`format` of the run's results on stdout: text, or json for a record of each changed directory with everything else on stderr")
+	fs.IntVar(&cfg.GroupDepth, "group-depth", cfg.GroupDepth, "how many leading numeric components of a version, 1 to 3, name its version directory; -group-by-patch uses the whole version instead")
+	fs.IntVar(&cfg.DownloadConcurrency, "download-concurrency", cfg.DownloadConcurrency, "number of tarballs to download at once for -checksum; this caps the downloads even when -concurrency updates more directories at once")
+	fs.BoolVar(&cfg.OnlyExisting, "only-existing", cfg.OnlyExisting, "only update version directories that already have a Dockerfile, skipping any others; -create-new still creates new ones")
+	fs.BoolVar(&cfg.FetchOnly, "fetch-only", cfg.FetchOnly, "only download the feeds into the -cache-dir, for a later -offline run, and exit")
+	fs.StringVar(&cfg.Lock, "lock", cfg.Lock, "generate the exact versions pinned for each version key in the JSON lock `file`, such as versions.lock, instead of the latest")
+	fs.BoolVar(&cfg.UpdateLock, "update-lock", cfg.UpdateLock, "rewrite the -lock file with the latest version for every version key and exit")
+	fs.IntVar(&cfg.RetryBudget, "retry-budget", cfg.RetryBudget, "most retries of truncated feed downloads to make in total across all of the feeds")
+	fs.Var(&stringList{list: &cfg.CompareWith}, "compare-with", "two `snapshots`, old then new, each a -cache-dir or a saved feed file, to resolve offline and print what changed between them, and exit")
+	fs.StringVar(&cfg.EAPTag, "eap-tag", cfg.EAPTag, "also tag the highest version from the EAP feed with `name`, such as next, for pre-release testers")
+	fs.Var(&cfg.MaxAge, "max-age", "warn, or with -strict fail, when even the newest resolved version was released longer than this `duration` ago, which can mean the feeds are stale (default no limit)")
+	fs.StringVar(&cfg.MultiStage, "multi-stage", cfg.MultiStage, "also render "+multiStageTemplate+" with every version being generated into one Dockerfile at `path`, under the -out-dir if there is one, with a build target per version; nothing is written without the template")
+	fs.BoolVar(&cfg.NoEAPInDirectories, "no-eap-in-directories", cfg.NoEAPInDirectories, "fail before writing anything if any existing version directory resolves to a release from the EAP feed")
+	fs.Var(&cfg.DownloadTimeout, "download-timeout", "longest each tarball download for -checksum can take before it is retried, as a `duration`; 0 means no limit")
+	fs.StringVar(&cfg.ShellVersions, "shell-versions", cfg.ShellVersions, "write the resolved versions to `file` as shell variables, such as CROWD_5_1_VERSION and CROWD_LATEST, for a CI script to source, and exit")
+	fs.Var(&keyValues{m: &cfg.URLRewrite}, "url-rewrite", "`from=to` URL prefixes, such as https://my.atlassian.com/=https://mirror.example.com/atlassian/, rewriting the feed URLs and the tarball URLs put in the Dockerfiles to go through a mirror; may be repeated")
+	fs.StringVar(&cfg.Sort, "sort", cfg.Sort, "order of the versions in the generated Makefile, -multi-stage Dockerfile and -shell-versions file: asc or desc")
+	fs.Var(&cfg.StabilityWindow, "stability-window", "leave out stable releases made within this `duration` of now, so each version resolves to the newest release that has been out at least that long (default none)")
+	fs.BoolVar(&cfg.Quiet, "quiet", cfg.Quiet, "leave out the status line, such as \"status=ok changed=2 created=1 pruned=0 warnings=1 errors=0\", printed last by every run, to stdout or, with -output json, -print-config or -list-changed, to stderr")
+	return fs
+}
+
+// parseConfig builds the Config for a run from the command line arguments.
+func parseConfig(args []string) (cfg Config, err error) {
+	var configFile string
+	cfg = defaultConfig()
+	if err := newFlagSet(&cfg, &configFile).Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if configFile != "" {
+		// Start again from the defaults so the file is applied before the
+		// flags, then parse the flags a second time so they win.
+		cfg = defaultConfig()
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return cfg, err
+		}
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			return cfg, err
+		}
+		if err := newFlagSet(&cfg, &configFile).Parse(args); err != nil {
+			return cfg, err
+		}
+	}
+
+	if cfg.Offline && cfg.CacheDir == "" {
+		return cfg, errors.New("-offline needs a -cache-dir to read from")
+	}
+	if len(cfg.CompareWith) != 0 && len(cfg.CompareWith) != 2 {
+		return cfg, fmt.Errorf("-compare-with needs two snapshots, old and new, not %d", len(cfg.CompareWith))
+	}
+	if cfg.UpdateLock && cfg.Lock == "" {
+		return cfg, errors.New("-update-lock needs a -lock file to write")
+	}
+	if cfg.FetchOnly && cfg.CacheDir == "" {
+		return cfg, errors.New("-fetch-only needs a -cache-dir to write to")
+	}
+	if cfg.ListChanged {
+		cfg.Check = true
+	}
+	for _, c := range conflictingFlags {
+		if flagSet[c[0]](cfg) && flagSet[c[1]](cfg) {
+			return cfg, fmt.Errorf("-%s can't be used with -%s", c[0], c[1])
+		}
+	}
+	if cfg.Output != "text" && cfg.Output != "json" {
+		return cfg, fmt.Errorf("-output must be text or json, not %q", cfg.Output)
+	}
+	if cfg.Sort != "asc" && cfg.Sort != "desc" {
+		return cfg, fmt.Errorf("-sort must be asc or desc, not %q", cfg.Sort)
+	}
+	for dir, r := range cfg.Directories {
+		if err := r.validate(); err != nil {
+			return cfg, fmt.Errorf("directories: %s: %w", dir, err)
+		}
+	}
+	if cfg.GroupDepth < 1 || cfg.GroupDepth > 3 {
+		return cfg, fmt.Errorf("-group-depth must be 1, 2 or 3, not %d", cfg.GroupDepth)
+	}
+	if cfg.EAPTag == "latest" {
+		return cfg, errors.New("-eap-tag can't be latest, which is the stable release's tag")
+	}
+	if cfg.VersionPattern == defaultVersionPattern {
+		cfg.VersionPattern = versionPatternFor(cfg)
+	}
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" && cfg.SourceDate.IsZero() {
+		if err := cfg.SourceDate.Set(epoch); err != nil {
+			return cfg, fmt.Errorf("SOURCE_DATE_EPOCH: %w", err)
+		}
+	}
+	return cfg, nil
+}
+
+// Duration is a time.Duration that is written as a string such as "90s" both
+// on the command line and in the config file.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
+
+// Timestamp is a time.Time that is written as an RFC 3339 string on the
+// command line and in the config file. Unix seconds, as in SOURCE_DATE_EPOCH,
+// are accepted too.
+type Timestamp time.Time
+
+func (t Timestamp) IsZero() bool {
+	return time.Time(t).IsZero()
+}
+
+func (t Timestamp) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return time.Time(t).UTC().Format(time.RFC3339)
+}
+
+func (t *Timestamp) Set(s string) error {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		*t = Timestamp(time.Unix(secs, 0))
+		return nil
+	}
+	v, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return err
+	}
+	*t = Timestamp(v)
+	return nil
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	if s == "" {
+		*t = Timestamp{}
+		return nil
+	}
+	return t.Set(s)
+}
+
+// stringList is a flag that may be repeated or given a comma separated list.
+// Values from the command line replace those from the config file rather than
+// adding to them.
+type stringList struct {
+	list *[]string
+	set  bool
+}
+
+func (l *stringList) String() string {
+	if l.list == nil {
+		return ""
+	}
+	return strings.Join(*l.list, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	if !l.set {
+		*l.list = nil
+		l.set = true
+	}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l.list = append(*l.list, v)
+		}
+	}
+	return nil
+}
+
+// URLList is the list of URLs a feed is fetched from. The entries of all of
+// them are merged into one feed. In the config file it may be a single URL
+// string or a list of them.
+type URLList []string
+
+func (l *URLList) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*l = URLList{url}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// keyValues is a flag of key=value pairs that may be repeated or given a comma
+// separated list. Like stringList, values from the command line replace those
+// from the config file.
+type keyValues struct {
+	m   *map[string]string
+	set bool
+}
+
+func (kv *keyValues) String() string {
+	if kv.m == nil {
+		return ""
+	}
+	var pairs []string
+	for k, v := range *kv.m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (kv *keyValues) Set(s string) error {
+	if !kv.set {
+		*kv.m = map[string]string{}
+		kv.set = true
+	}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("%q is not a key=value pair", pair)
+		}
+		(*kv.m)[k] = v
+	}
+	return nil
+}
+
+// printConfig writes cfg as indented JSON for -print-config. Passwords in URLs
+// and the values of template data that look like credentials are redacted.
+func printConfig(w io.Writer, cfg Config) error {
+	cfg = cloneConfig(cfg)
+	for _, list := range []URLList{cfg.CurrentFeed, cfg.ArchiveFeed, cfg.EAPFeed} {
+		for i := range list {
+			list[i] = redactURL(list[i])
+		}
+	}
+	cfg.RegistryCheck = redactURL(cfg.RegistryCheck)
+	for k, v := range cfg.URLRewrite {
+		cfg.URLRewrite[k] = redactURL(v)
+	}
+	for k, v := range cfg.TemplateData {
+		cfg.TemplateData[k] = redactURL(v)
+		if secretKey.MatchString(k) {
+			cfg.TemplateData[k] = "xxxxx"
+		}
+	}
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// redactURL hides the password in s if it is a URL with one.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// coverage prints, for each feed channel, how many entries it has, how many
+// version keys they cover and how many of those it supplied after resolution,
+// then lists the keys that only the archive or EAP feed has. Those are the
+// lines that have aged out of the current feed or not yet reached it. Like
+// explain it writes nothing.
+func coverage(ctx context.Context, w io.Writer, f *fetcher, feeds []feed) error {
+	fetched, err := f.readFeeds(ctx, feeds)
+	if err != nil {
+		return err
+	}
+	err = parseFeeds(fetched, func(p Package) bool {
+		return f.skipReason(p) == ""
+	})
+	if err != nil {
+		return err
+	}
+	versions := f.resolve(fetched)
+
+	var channels []string
+	entries := map[string]int{}
+	keys := map[string]map[string]bool{}
+	for _, fe := range fetched {
+		ch := fe.feed.Channel
+		if keys[ch] == nil {
+			channels = append(channels, ch)
+			keys[ch] = map[string]bool{}
+		}
+		for _, p := range fe.pkgs {
+			entries[ch]++
+			keys[ch][f.groupKey(p)] = true
+		}
+	}
+	resolved := map[string]int{}
+	for _, p := range versions {
+		resolved[p.Channel]++
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "channel\tentries\tversions\tresolved")
+	for _, ch := range channels {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\n", ch, entries[ch], len(keys[ch]), resolved[ch])
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for _, ch := range []string{channelArchive, channelEAP} {
+		var only []string
+		for key := range keys[ch] {
+			if inOneChannel(keys, key) {
+				only = append(only, key)
+			}
+		}
+		if len(only) == 0 {
+			continue
+		}
+		sort.Slice(only, func(i, j int) bool { return Version(only[i]).Compare(Version(only[j])) < 0 })
+		fmt.Fprintf(w, "only in the %s feed: %s\n", ch, strings.Join(only, ", "))
+	}
+	return nil
+}
+
+// inOneChannel reports whether key is in the keys of just one channel.
+func inOneChannel(keys map[string]map[string]bool, key string) bool {
+	n := 0
+	for _, k := range keys {
+		if k[key] {
+			n++
+		}
+	}
+	return n == 1
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// versionRule is what a directory listed in the config file's "directories"
+// resolves to instead of the version its name implies: an exact version such
+// as "5.1.3", the latest of a minor, "5.1.x", or the latest of a major, "5.x".
+// The -lock file's pins are rules too, made by pinRule.
+type versionRule string
+
+// pinRule is the rule for the version key pinned to v by the -lock file: v
+// exactly, from the packages resolved for key, so that with
+// -separate-editions a pin never picks the other edition's build.
+func pinRule(key string, v Version) versionRule {
+	return versionRule(key + "=" + string(v))
+}
+
+// pin returns the key and version of a rule made by pinRule.
+func (r versionRule) pin() (key string, v Version, ok bool) {
+	key, version, ok := strings.Cut(string(r), "=")
+	return key, Version(version), ok
+}
+
+func (r versionRule) validate() error {
+	if !wildcardRule.MatchString(string(r)) && !usableVersion.MatchString(string(r)) {
+		return fmt.Errorf("%q is neither a version nor a major or minor ending in .x", string(r))
+	}
+	return nil
+}
+
+// matches reports whether v satisfies r.
+func (r versionRule) matches(v Version) bool {
+	if _, pinned, ok := r.pin(); ok {
+		return v.Compare(pinned) == 0
+	}
+	prefix, wildcard := strings.CutSuffix(string(r), ".x")
+	if !wildcard {
+		return v.Compare(Version(r)) == 0
+	}
+	want := versionSeparator.Split(prefix, -1)
+	have := versionSeparator.Split(string(v), -1)
+	if len(have) < len(want) {
+		return false
+	}
+	for i := range want {
+		if compareComponent(want[i], have[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// versionRules returns the distinct rules in directories and any more, sorted.
+func versionRules(directories map[string]versionRule, more ...versionRule) []versionRule {
+	seen := map[versionRule]bool{}
+	var rules []versionRule
+	for _, r := range directories {
+		more = append(more, r)
+	}
+	for _, r := range more {
+		if !seen[r] {
+			seen[r] = true
+			rules = append(rules, r)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i] < rules[j] })
+	return rules
+}
+
+// resolveRules picks the package for each of f.rules from the parsed entries
+// of fetched, following the same preferences as resolve.
+func (f *fetcher) resolveRules(fetched []feedEntries) map[versionRule]Package {
+	ruled := map[versionRule]Package{}
+	for _, r := range f.rules {
+		for _, fe := range fetched {
+			for _, p := range fe.pkgs {
+				if !r.matches(p.Version) {
+					continue
+				}
+				if key, _, ok := r.pin(); ok && f.groupKey(p) != key {
+					continue
+				}
+				if q, ok := ruled[r]; !ok || f.replaces(p, q) {
+					ruled[r] = p
+				}
+			}
+		}
+	}
+	return ruled
+}
+
+// isVersionDir reports whether dir is a version directory, either by its name
+// or by being listed in the config file's "directories".
+func isVersionDir(dir string, cfg Config) bool {
+	if _, ok := cfg.Directories[dir]; ok {
+		return true
+	}
+	_, ok := versionKey(dir)
+	return ok
+}
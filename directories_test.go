@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestVersionRuleMatches(t *testing.T) {
+	for _, tt := range []struct {
+		rule versionRule
+		v    Version
+		want bool
+	}{
+		{"5.1.3", "5.1.3", true},
+		{"5.1.3", "5.1.4", false},
+		{"5.1", "5.1.0", true},
+		{"5.1.x", "5.1.3", true},
+		{"5.1.x", "5.1", true},
+		{"5.1.x", "5.10.0", false},
+		{"5.1.x", "5.2.0", false},
+		{"5.x", "5.10.1", true},
+		{"5.x", "50.1.0", false},
+		{"5.x", "6.0.0", false},
+		{"5.x", "5", true},
+		{"5.1.x", "5", false},
+		{pinRule("5.1-dc", "5.1.3"), "5.1.3", true},
+		{pinRule("5.1-dc", "5.1.3"), "5.1.4", false},
+	} {
+		if got := tt.rule.matches(tt.v); got != tt.want {
+			t.Errorf("%s.matches(%s) = %t, want %t", tt.rule, tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"text/template"
+)
+
+// dirTemplateFile is the name of the template a version directory, or one of
+// its variant subdirectories, can have to be generated from instead of the
+// repository's Dockerfile.tmpl.
+const dirTemplateFile = "Dockerfile.tmpl"
+
+// dirTemplates caches the templates found in directories, and a nil for each
+// directory found to have none, so each is only looked for and parsed once.
+var dirTemplates = struct {
+	sync.Mutex
+	m map[string]*template.Template
+}{m: map[string]*template.Template{}}
+
+// templateFor returns the template the Dockerfile for t is rendered from: the
+// one in t's directory, else with a variant the one in its version directory,
+// else tmpl.
+func templateFor(t target) (*template.Template, error) {
+	dirs := []string{t.dir}
+	if t.data.Variant.Name != "" {
+		dirs = append(dirs, filepath.Dir(t.dir))
+	}
+	for _, dir := range dirs {
+		dt, err := dirTemplate(dir)
+		if err != nil {
+			return nil, err
+		}
+		if dt != nil {
+			return dt, nil
+		}
+	}
+	return tmpl, nil
+}
+
+func dirTemplate(dir string) (*template.Template, error) {
+	dirTemplates.Lock()
+	defer dirTemplates.Unlock()
+	if dt, ok := dirTemplates.m[dir]; ok {
+		return dt, nil
+	}
+	name := filepath.Join(dir, dirTemplateFile)
+	var dt *template.Template
+	if _, err := os.Stat(name); err == nil {
+		if dt, err = template.ParseFiles(name); err != nil {
+			return nil, err
+		}
+		debugf("%s has its own %s", dir, dirTemplateFile)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	dirTemplates.m[dir] = dt
+	return dt, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"time"
+)
+
+// progressInterval is how often a download in progress is logged.
+var progressInterval = 10 * time.Second
+
+// checksum downloads the tarball at url and returns its SHA-256 in hex. The
+// tarballs are large, so progress is logged as it goes, and no more than
+// -download-concurrency are downloaded at once. A download that takes longer
+// than the -download-timeout is retried like a truncated feed, up to
+// feedAttempts times in all.
+func (f *fetcher) checksum(ctx context.Context, url string) (string, error) {
+	select {
+	case f.downloads <- struct{}{}:
+		defer func() { <-f.downloads }()
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	for attempt := 1; ; attempt++ {
+		sum, err := f.checksumOnce(ctx, url)
+		if err == nil {
+			return sum, nil
+		}
+		if !errors.Is(err, errDownloadTimeout) || attempt == feedAttempts {
+			return "", err
+		}
+		warnf("download_timeout", "%s; retrying (attempt %d of %d)", err, attempt+1, feedAttempts)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(time.Duration(attempt) * feedRetryDelay):
+		}
+	}
+}
+
+// errDownloadTimeout is returned for a tarball download that ran past the
+// -download-timeout.
+var errDownloadTimeout = errors.New("download timed out")
+
+// checksumOnce makes one attempt at downloading the tarball at url for
+// checksum.
+func (f *fetcher) checksumOnce(ctx context.Context, url string) (sum string, err error) {
+	if f.downloadTimeout > 0 {
+		// Only this attempt's own deadline is a timeout to retry, not the
+		// run being stopped by -timeout.
+		run := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.downloadTimeout)
+		defer cancel()
+		defer func() {
+			if err != nil && run.Err() == nil && ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("%w: GET %s took longer than the -download-timeout of %s", errDownloadTimeout, url, f.downloadTimeout)
+			}
+		}()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := f.do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+
+	h := sha256.New()
+	pr := &progressReader{
+		r:     resp.Body,
+		name:  path.Base(url),
+		total: resp.ContentLength,
+		last:  time.Now(),
+	}
+	if _, err := io.Copy(h, pr); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// progressReader logs how much of a download has been read at most once every
+// progressInterval. total is -1 when the length isn't known.
+type progressReader struct {
+	r     io.Reader
+	name  string
+	total int64
+	n     int64
+	last  time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if now := time.Now(); now.Sub(p.last) >= progressInterval {
+		p.last = now
+		if p.total > 0 {
+			infof("downloading %s: %d of %d bytes (%d%%)", p.name, p.n, p.total, p.n*100/p.total)
+		} else {
+			infof("downloading %s: %d bytes", p.name, p.n)
+		}
+	}
+	return n, err
+}
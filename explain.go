@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// explain prints how the feeds resolve the version key: every
+// entry for it in each feed, why any were filtered out, and which candidate
+// won and on what basis. It follows the same rules as getVersions but writes
+// nothing.
+func explain(ctx context.Context, w io.Writer, f *fetcher, feeds []feed, key string) error {
+	fetched, err := f.fetchFeeds(ctx, feeds)
+	if err != nil {
+		return err
+	}
+
+	var best *Package
+	for _, fe := range fetched {
+		var found bool
+		for _, p := range fe.pkgs {
+			if f.groupKey(p) != key {
+				continue
+			}
+			if !found {
+				fmt.Fprintf(w, "%s feed (%s):\n", fe.feed.Channel, fe.url)
+				found = true
+			}
+			if reason := f.skipReason(p); reason != "" {
+				fmt.Fprintf(w, "  filtered %s %q: %s\n", p.Version, p.ZipURL, reason)
+				continue
+			}
+			switch {
+			case best == nil:
+				fmt.Fprintf(w, "  candidate %s: first candidate\n", p)
+			case f.replaces(p, *best):
+				fmt.Fprintf(w, "  candidate %s: replaces %s from the %s feed, %s\n", p, best.Version, best.Channel, f.preferenceBasis(p, *best))
+			default:
+				fmt.Fprintf(w, "  candidate %s: loses to %s from the %s feed, %s\n", p, best.Version, best.Channel, f.preferenceBasis(*best, p))
+				continue
+			}
+			best = &p
+		}
+		if !found {
+			fmt.Fprintf(w, "%s feed (%s): no entries for %s\n", fe.feed.Channel, fe.url, key)
+		}
+	}
+
+	if best == nil {
+		return fmt.Errorf("can't find url for version %s", key)
+	}
+	fmt.Fprintf(w, "resolved %s to %s\n", key, *best)
+	return nil
+}
+
+// preferenceBasis describes why getVersions prefers p over q.
+func (f *fetcher) preferenceBasis(p, q Package) string {
+	switch {
+	case (p.Channel == channelEAP) != (q.Channel == channelEAP):
+		return "stable release over EAP"
+	case f.includeWar && p.Version.Compare(q.Version) == 0 && p.Artifact != q.Artifact:
+		return "same version, war build with -include-war"
+	case p.Version.Compare(q.Version) != 0:
+		return "higher version"
+	case path.Base(p.ZipURL) != path.Base(q.ZipURL):
+		return "same version, shorter or alphabetically first filename"
+	case time.Time(p.Released).After(time.Time(q.Released)):
+		return "same version, later release date"
+	}
+	return "same version and release date, later feed takes priority"
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// The channels the atlassian feeds publish releases under.
+const (
+	channelCurrent = "current"
+	channelArchive = "archive"
+	channelEAP     = "eap"
+)
+
+// feed is one of the atlassian download feeds. It may be split across several
+// URLs, in which case the entries from all of them are merged.
+type feed struct {
+	Channel string
+	URLs    []string
+}
+
+// feeds lists the configured feeds from the lowest priority to the highest.
+// With -keep-archive-only that is just the archive feed, so a release only in
+// the current feed is never picked.
+func (cfg Config) feeds() []feed {
+	if cfg.KeepArchiveOnly {
+		return []feed{{channelArchive, cfg.ArchiveFeed}}
+	}
+	return []feed{
+		{channelArchive, cfg.ArchiveFeed},
+		{channelEAP, cfg.EAPFeed},
+		{channelCurrent, cfg.CurrentFeed},
+	}
+}
+
+// fetcher reads the atlassian feeds. When cacheDir is set every feed body
+// that is downloaded is also saved there, and with offline set the feeds are
+// read back from the cache instead of the network. With parallel set the
+// feeds are fetched at the same time rather than one after another.
+type fetcher struct {
+	cacheDir string
+	offline  bool
+	parallel bool
+
+	// includeWar keeps war builds when resolving versions, groupDepth is how
+	// many components of a version make its key, groupByPatch resolves each
+	// full version separately instead, and separateEditions resolves Data
+	// Center builds separately.
+	includeWar       bool
+	groupDepth       int
+	groupByPatch     bool
+	separateEditions bool
+
+	// rules are the distinct rules of the config file's directories, each
+	// resolved as well as the version keys.
+	rules []versionRule
+
+	// strict makes any feed that can't be read fatal.
+	strict bool
+
+	// stableCutoff is the end of the -stability-window, if there is one:
+	// stable releases from after it are left out.
+	stableCutoff time.Time
+
+	// retries is how many of the retryBudget retries of feed downloads are
+	// left for all of the feeds together.
+	retries     atomic.Int64
+	retryBudget int
+
+	// downloads holds a token for each tarball being downloaded, so that
+	// there are at most -download-concurrency at once, and each attempt at
+	// one is given downloadTimeout.
+	downloads       chan struct{}
+	downloadTimeout time.Duration
+
+	// fsync is -fsync, for the files written to the cache.
+	fsync bool
+
+	// feedsKey is the resolution key of the feeds getVersions last read.
+	feedsKey string
+
+	// unavailable counts the feed URLs readFeeds has left out because they
+	// couldn't be read. While any are, the run is degraded: nothing is
+	// pruned and the -lock file isn't updated.
+	unavailable int
+
+	// client sends every request, each with userAgent.
+	client    *http.Client
+	userAgent string
+
+	// urlRewrite maps URL prefixes to the -url-rewrite mirror prefixes
+	// that replace them.
+	urlRewrite map[string]string
+}
+
+func newFetcher(cfg Config) *fetcher {
+	f := &fetcher{
+		cacheDir:         cfg.CacheDir,
+		offline:          cfg.Offline,
+		parallel:         cfg.ParallelFeeds,
+		includeWar:       cfg.IncludeWar,
+		groupDepth:       cfg.GroupDepth,
+		groupByPatch:     cfg.GroupByPatch,
+		separateEditions: cfg.SeparateEditions,
+		rules:            versionRules(cfg.Directories),
+		strict:           cfg.Strict,
+		retryBudget:      cfg.RetryBudget,
+		downloads:        make(chan struct{}, max(cfg.DownloadConcurrency, 1)),
+		downloadTimeout:  time.Duration(cfg.DownloadTimeout),
+		client:           &http.Client{},
+		userAgent:        cfg.UserAgent,
+		urlRewrite:       cfg.URLRewrite,
+		fsync:            cfg.Fsync,
+	}
+	f.retries.Store(int64(cfg.RetryBudget))
+	if cfg.StabilityWindow > 0 {
+		f.stableCutoff = time.Now().Add(-time.Duration(cfg.StabilityWindow))
+	}
+	return f
+}
+
+// rewrite returns url with the longest of the -url-rewrite prefixes it starts
+// with replaced, or url itself if it starts with none of them.
+func (f *fetcher) rewrite(url string) string {
+	var from string
+	for prefix := range f.urlRewrite {
+		if strings.HasPrefix(url, prefix) && len(prefix) > len(from) {
+			from = prefix
+		}
+	}
+	if from == "" {
+		return url
+	}
+	return f.urlRewrite[from] + strings.TrimPrefix(url, from)
+}
+
+// do sends req with the fetcher's client and User-Agent.
+func (f *fetcher) do(req *http.Request) (*http.Response, error) {
+	if f.userAgent != "" {
+		req.Header.Set("User-Agent", f.userAgent)
+	}
+	return f.client.Do(req)
+}
+
+// readFeed returns the raw body of the feed at url.
+func (f *fetcher) readFeed(ctx context.Context, url string) ([]byte, error) {
+	if name, ok := localFeed(url); ok {
+		return ioutil.ReadFile(name)
+	}
+	if f.offline {
+		data, err := ioutil.ReadFile(f.cachePath(url))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no cached copy of %s in %s", url, f.cacheDir)
+		}
+		return data, err
+	}
+
+	var data []byte
+	for attempt := 1; ; attempt++ {
+		var err error
+		data, err = f.download(ctx, url)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errTruncatedFeed) || attempt == feedAttempts {
+			return nil, err
+		}
+		if f.retries.Add(-1) < 0 {
+			return nil, fmt.Errorf("%w; the -retry-budget of %d retries across all feeds is used up", err, f.retryBudget)
+		}
+		warnf("truncated_feed", "%s; retrying (attempt %d of %d)", err, attempt+1, feedAttempts)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Duration(attempt) * feedRetryDelay):
+		}
+	}
+
+	if f.cacheDir != "" {
+		if err := os.MkdirAll(f.cacheDir, 0755); err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(f.cachePath(url), data, 0644, f.fsync); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// errTruncatedFeed is returned for a feed response that was cut off part
+// way, such as by a dropped connection. Those are retried.
+var errTruncatedFeed = errors.New("truncated feed response")
+
+// A truncated feed response is tried up to feedAttempts times in all, waiting
+// feedRetryDelay longer before each retry, as long as the -retry-budget shared
+// by every feed has retries left.
+var (
+	feedAttempts   = 3
+	feedRetryDelay = time.Second
+)
+
+// download GETs the feed at url and returns its body, checking that the whole
+// of it arrived.
+func (f *fetcher) download(ctx context.Context, url string) ([]byte, error) {
+	url = f.rewrite(url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+
+	// The transport decompresses gzip itself and drops the header when it does,
+	// so it is only still set if the body has to be decompressed here.
+	body := io.Reader(resp.Body)
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := ioutil.ReadAll(body)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, fmt.Errorf("%w from %s: %s", errTruncatedFeed, url, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	debugf("fetched %s in %s (%d bytes)", url, time.Since(start).Round(time.Millisecond), len(data))
+
+	// Content-Length describes the body as sent, so it can only be checked
+	// when the body wasn't decompressed here. Either way a JSONP body has to
+	// end with the call's closing ")".
+	if resp.ContentLength >= 0 && body == resp.Body && int64(len(data)) != resp.ContentLength {
+		return nil, fmt.Errorf("%w from %s: got %d of %d bytes", errTruncatedFeed, url, len(data), resp.ContentLength)
+	}
+	if open := bytes.IndexByte(data, '('); open >= 0 && !bytes.HasSuffix(bytes.TrimRight(data, " \t\r\n;"), []byte(")")) {
+		return nil, fmt.Errorf("%w from %s: no closing \")\"", errTruncatedFeed, url)
+	}
+	return data, nil
+}
+
+// reachable checks that the feed at url can be read, with a HEAD request to
+// where -url-rewrite sends it or by looking in the cache when offline.
+func (f *fetcher) reachable(ctx context.Context, url string) error {
+	if name, ok := localFeed(url); ok {
+		_, err := os.Stat(name)
+		return err
+	}
+	if f.offline {
+		_, err := os.Stat(f.cachePath(url))
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, f.rewrite(url), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := f.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("HEAD returned %s", resp.Status)
+	}
+	return nil
+}
+
+// fetchOnly downloads every feed into the cache, as readFeed does, and lists
+// what it cached. Feeds read from disk aren't cached and are left out. As a
+// later -offline run would resolve from whatever is there, a feed that
+// couldn't be downloaded is an error rather than a warning.
+func (f *fetcher) fetchOnly(ctx context.Context, w io.Writer, feeds []feed) error {
+	fetched, err := f.readFeeds(ctx, feeds)
+	if err != nil {
+		return err
+	}
+	for _, fe := range fetched {
+		if _, ok := localFeed(fe.url); ok {
+			continue
+		}
+		fmt.Fprintf(w, "cached %s feed %s in %s (%d bytes)\n", fe.feed.Channel, fe.url, filepath.ToSlash(f.cachePath(fe.url)), len(fe.body))
+	}
+	if f.unavailable > 0 {
+		return fmt.Errorf("cache is incomplete: %d of the feed URLs couldn't be read", f.unavailable)
+	}
+	return nil
+}
+
+// cachePath is where the body of the feed at url is cached.
+func (f *fetcher) cachePath(url string) string {
+	return filepath.Join(f.cacheDir, unsafeCacheChars.ReplaceAllString(url, "_"))
+}
+
+// localFeed returns the file a feed URL refers to when it is a file:// URL or
+// a plain path, such as a checked-in fixture or a local mirror. Those are read
+// straight from disk, even when offline, and never cached.
+func localFeed(feedURL string) (string, bool) {
+	if !strings.Contains(feedURL, "://") {
+		return feedURL, true
+	}
+	u, err := url.Parse(feedURL)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
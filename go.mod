@@ -0,0 +1,3 @@
+module github.com/nkatsaros/docker-atlassian-crowd
+
+go 1.21
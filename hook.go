@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// runPostHook runs the -post-hook command for the directory dir once it has
+// been generated for p. The command gets dir as its only argument and also in
+// CROWD_DIR, with the version in CROWD_VERSION. Its output is only shown with
+// -verbose, or as part of the error when it fails.
+func runPostHook(ctx context.Context, dir string, p Package, cfg Config) error {
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, cfg.PostHook, dir)
+	cmd.Env = append(os.Environ(), "CROWD_DIR="+dir, "CROWD_VERSION="+string(p.Version))
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post-hook %s %s: %w\n%s", cfg.PostHook, dir, err, bytes.TrimSpace(out.Bytes()))
+	}
+	if out.Len() > 0 {
+		debugf("post-hook %s %s: %s", cfg.PostHook, dir, bytes.TrimSpace(out.Bytes()))
+	}
+	return nil
+}
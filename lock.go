@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// loadLock reads the -lock file, which maps version keys to the exact version
+// each is pinned to. A lock file that doesn't exist yet pins nothing.
+func loadLock(name string) (map[string]Version, error) {
+	lock := map[string]Version{}
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return lock, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", name, err)
+	}
+	return lock, nil
+}
+
+// lockRules returns the pinRule for each version key pinned in lock.
+func lockRules(lock map[string]Version) []versionRule {
+	var rules []versionRule
+	for key, v := range lock {
+		rules = append(rules, pinRule(key, v))
+	}
+	return rules
+}
+
+// applyLock replaces the resolved package for every version key pinned in
+// lock with the pinned version, which ruled has from lockRules. A pin that is
+// no longer in any feed is an error. Keys the lock doesn't mention keep the
+// latest version, with a warning.
+func applyLock(versions map[string]Package, ruled map[versionRule]Package, lock map[string]Version, name string) error {
+	var gone []string
+	for key, v := range lock {
+		p, ok := ruled[pinRule(key, v)]
+		if !ok {
+			gone = append(gone, fmt.Sprintf("%s (for %s)", v, key))
+			continue
+		}
+		versions[key] = p
+	}
+	if len(gone) > 0 {
+		sort.Strings(gone)
+		return fmt.Errorf("%s pins versions that are no longer in any feed: %s", name, strings.Join(gone, ", "))
+	}
+	for key, p := range versions {
+		if _, ok := lock[key]; !ok {
+			warnf("unlocked_version", "%s isn't pinned in %s; using the latest, %s", key, name, p.Version)
+		}
+	}
+	return nil
+}
+
+// updateLock rewrites the -lock file to pin every version key to the version
+// just resolved for it, and prints what changed.
+func updateLock(name string, versions map[string]Package, cfg Config) error {
+	old, err := loadLock(name)
+	if err != nil {
+		return err
+	}
+	lock := map[string]Version{}
+	var keys []string
+	for key, p := range versions {
+		lock[key] = p.Version
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return Version(keys[i]).Compare(Version(keys[j])) < 0 })
+	for _, key := range keys {
+		switch v, ok := old[key]; {
+		case !ok:
+			fmt.Printf("pinned %s to %s\n", key, lock[key])
+		case v != lock[key]:
+			fmt.Printf("moved %s from %s to %s\n", key, v, lock[key])
+		}
+	}
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(name, append(data, '\n'), 0644, cfg.Fsync)
+}
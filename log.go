@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// verbose enables debug output. It is set from the -verbose flag.
+var verbose bool
+
+// logOut is where plain debug output, progress and warnings go: stdout, or
+// stderr with -output json so that stdout only holds the results.
+var logOut io.Writer = os.Stdout
+
+// jsonLog is set with -log-json, in which case debug output and warnings are
+// written to stderr as JSON records instead of plain text.
+var jsonLog *slog.Logger
+
+func setupLogging(cfg Config) {
+	verbose = cfg.Verbose
+	if cfg.Output == "json" {
+		logOut = os.Stderr
+	}
+	if !cfg.LogJSON {
+		return
+	}
+	level := slog.LevelInfo
+	if verbose {
+		level = slog.LevelDebug
+	}
+	jsonLog = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+}
+
+// debugf prints a line of debug output when running with -verbose.
+func debugf(format string, args ...interface{}) {
+	if jsonLog != nil {
+		jsonLog.Debug(fmt.Sprintf(format, args...))
+		return
+	}
+	if verbose {
+		fmt.Fprintf(logOut, format+"\n", args...)
+	}
+}
+
+// infof prints a line of progress.
+func infof(format string, args ...interface{}) {
+	if jsonLog != nil {
+		jsonLog.Info(fmt.Sprintf(format, args...))
+		return
+	}
+	fmt.Fprintf(logOut, format+"\n", args...)
+}
+
+// warnf prints a warning. With -log-json the record carries kind as its
+// warning_type so that warnings can be counted by kind; kinds are short
+// snake_case names that should not change once added.
+func warnf(kind, format string, args ...interface{}) {
+	warnings.Add(1)
+	if jsonLog != nil {
+		jsonLog.Warn(fmt.Sprintf(format, args...), "warning_type", kind)
+		return
+	}
+	fmt.Fprintf(logOut, "warning: "+format+"\n", args...)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+)
+
+// build is a docker build of one generated Dockerfile.
+type build struct {
+	Dir  string
+	Tags []string
+}
+
+// builds lists a build for every target of the version directories in the
+// plan that are being created or updated, in -sort order of their versions
+// and otherwise in directory order. Version directories that are skipped,
+// such as held ones, are kept buildable from the Dockerfiles they already
+// have, tagged for the version in those. Without a -tag-prefix the tags are
+// for the Makefile's $(IMAGE).
+func builds(plan []planEntry, cfg Config) []build {
+	if cfg.TagPrefix == "" {
+		cfg.TagPrefix = "$(IMAGE):"
+	}
+	var entries []planEntry
+	for _, e := range plan {
+		switch {
+		case e.Action == actionCreate || e.Action == actionUpdate:
+			entries = append(entries, e)
+		case e.Action == actionSkip && e.Key != "":
+			if kept, ok := keptEntry(e, e.config(cfg)); ok {
+				entries = append(entries, kept)
+			}
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return versionsInOrder(entries[i].Package.Version, entries[j].Package.Version, cfg.Sort)
+	})
+	var bs []build
+	for _, e := range entries {
+		ecfg := e.config(cfg)
+		if ecfg.TagPrefix == "" {
+			ecfg.TagPrefix = cfg.TagPrefix
+		}
+		for _, t := range targets(e, ecfg) {
+			if e.Action == actionSkip && !fileExists(filepath.Join(t.dir, "Dockerfile")) {
+				continue
+			}
+			bs = append(bs, build{Dir: filepath.ToSlash(t.dir), Tags: tags(t, ecfg)})
+		}
+	}
+	return bs
+}
+
+// keptEntry returns the skipped entry e with the package its existing
+// Dockerfile was generated for, as far as previousPackage can tell, or false
+// if it has no Dockerfile to tell from.
+func keptEntry(e planEntry, cfg Config) (planEntry, bool) {
+	for _, t := range targets(e, cfg) {
+		if v, url := previousPackage(t.dir); v != "" {
+			e.Package = Package{Version: v, ZipURL: url}
+			return e, true
+		}
+	}
+	return e, false
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// versionsInOrder reports whether a comes before b in the -sort order, asc
+// or desc. Equal versions are not in order either way.
+func versionsInOrder(a, b Version, order string) bool {
+	if order == "desc" {
+		return a.Compare(b) > 0
+	}
+	return a.Compare(b) < 0
+}
+
+// tags returns the image tags for a target: its major.minor key, or the
+// directory name for one mapped in the config file's directories, the full
+// version with -patch-in-tag, the major for the highest release of each major
+// with -select-latest-per-major, the -eap-tag for the highest EAP release, and
+// latest for the latest release. With -separate-editions the tags after the
+// key, other than the -eap-tag, end in "-dc" for a Data Center build, as the
+// key does. Variants add their name as a suffix to each, and every tag starts
+// with the -tag-prefix.
+func tags(t target, cfg Config) []string {
+	var edition string
+	if cfg.SeparateEditions && t.data.Edition != "" {
+		edition = "-" + t.data.Edition
+	}
+	tags := []string{t.key}
+	if cfg.PatchInTag && string(t.data.Version)+edition != t.key {
+		tags = append(tags, string(t.data.Version)+edition)
+	}
+	if t.data.MajorLatest {
+		tags = append(tags, t.data.Version.Major()+edition)
+	}
+	if t.data.EAPLatest {
+		tags = append(tags, cfg.EAPTag)
+	}
+	if t.data.Latest {
+		tags = append(tags, "latest"+edition)
+	}
+	for i := range tags {
+		if t.data.Variant.Name != "" {
+			tags[i] += "-" + t.data.Variant.Name
+		}
+		tags[i] = cfg.TagPrefix + tags[i]
+	}
+	return tags
+}
+
+// writeMakefile executes Makefile.tmpl with the builds and writes the result
+// to Makefile, in the -out-dir if there is one.
+func writeMakefile(bs []build, cfg Config) error {
+	t, err := template.ParseFiles("Makefile.tmpl")
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, bs); err != nil {
+		return err
+	}
+	if cfg.OutDir != "" {
+		if err := os.MkdirAll(cfg.OutDir, 0755); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomic(filepath.Join(cfg.OutDir, "Makefile"), buf.Bytes(), 0644, cfg.Fsync)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/template"
+)
+
+// multiStageTemplate is rendered with -multi-stage into a single Dockerfile
+// with a build stage for every version.
+const multiStageTemplate = "Dockerfile.multi.tmpl"
+
+// stage is one build stage of the -multi-stage Dockerfile, for a version
+// directory. Key is the directory's version key, which unlike the package's
+// major.minor is different for every directory, so it can name the stage.
+type stage struct {
+	Key string
+	Dir string
+	Package
+}
+
+// multiStageData is what multiStageTemplate is executed with: the stages,
+// and for the base stage they share the same BaseImage and JDK as
+// Dockerfile.tmpl, with the entrypoint copied from its -entrypoint-src to
+// its -entrypoint-dst name.
+type multiStageData struct {
+	Stages        []stage
+	BaseImage     string
+	JDK           string
+	EntrypointSrc string
+	Entrypoint    string
+}
+
+// stages returns a stage for every version directory in the plan that was
+// created or updated, with the package from its result so that it has the
+// SHA256 from -checksum, in -sort order. As in the Makefile, skipped version
+// directories, such as held ones, keep a stage for the version their
+// existing Dockerfile is for.
+func stages(plan []planEntry, results []dirResult, cfg Config) []stage {
+	var ss []stage
+	for i, e := range plan {
+		switch {
+		case (e.Action == actionCreate || e.Action == actionUpdate) && results[i].err == nil:
+			ss = append(ss, stage{Key: e.Key, Dir: filepath.ToSlash(e.Dir), Package: results[i].pkg})
+		case e.Action == actionSkip && e.Key != "":
+			if kept, ok := keptEntry(e, e.config(cfg)); ok {
+				ss = append(ss, stage{Key: e.Key, Dir: filepath.ToSlash(e.Dir), Package: kept.Package})
+			}
+		}
+	}
+	sort.SliceStable(ss, func(i, j int) bool { return versionsInOrder(ss[i].Version, ss[j].Version, cfg.Sort) })
+	return ss
+}
+
+// writeMultiStage executes multiStageTemplate with the stages and writes the
+// result to the -multi-stage file, in the -out-dir if there is one. It does
+// nothing when there's no template to execute.
+func writeMultiStage(ss []stage, cfg Config) error {
+	name := filepath.Join(cfg.OutDir, cfg.MultiStage)
+	if _, err := os.Stat(multiStageTemplate); os.IsNotExist(err) {
+		debugf("no %s, not writing %s", multiStageTemplate, name)
+		return nil
+	}
+	t, err := template.ParseFiles(multiStageTemplate)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	data := multiStageData{
+		Stages:        ss,
+		BaseImage:     cfg.BaseImage,
+		JDK:           cfg.JDK,
+		EntrypointSrc: filepath.ToSlash(cfg.EntrypointSrc),
+		Entrypoint:    cfg.EntrypointDst,
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(name, buf.Bytes(), 0644, cfg.Fsync)
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMultiStage renders the -multi-stage file for an updated and a created
+// directory and a held one, which keeps the version of its Dockerfile.
+func TestMultiStage(t *testing.T) {
+	root := inTempRepo(t, "2.10", "2.11")
+	held := "FROM scratch\nENV CROWD_VERSION 2.10.3\n"
+	if err := os.WriteFile(filepath.Join(root, "2.10", "Dockerfile"), []byte(held), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.MultiStage = "Dockerfile.multi"
+	cfg.BaseImage = "example/base:1"
+	cfg.JDK = "11"
+	cfg.EntrypointDst = "entrypoint.sh"
+	p211 := Package{Version: "2.11.1", ZipURL: "https://example.com/atlassian-crowd-2.11.1.tar.gz", SHA256: "abc123"}
+	p212 := Package{Version: "2.12.0", ZipURL: "https://example.com/atlassian-crowd-2.12.0.tar.gz"}
+	plan := []planEntry{
+		{Dir: "2.10", Key: "2.10", Action: actionSkip, Reason: "held"},
+		{Dir: "2.11", Key: "2.11", Action: actionUpdate, Package: p211},
+		{Dir: "2.12", Key: "2.12", Action: actionCreate, Package: p212},
+	}
+	results := []dirResult{{}, {pkg: p211}, {pkg: p212}}
+	if err := writeMultiStage(stages(plan, results, cfg), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(root, cfg.MultiStage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(data)
+	last := -1
+	for _, want := range []string{
+		"FROM example/base:1 AS base",
+		"openjdk-11-jre-headless",
+		"COPY ./docker-entrypoint.sh /entrypoint.sh",
+		`ENTRYPOINT ["/entrypoint.sh"]`,
+		"FROM base AS crowd-2.10",
+		"ENV CROWD_VERSION 2.10.3",
+		"FROM base AS crowd-2.11",
+		"echo 'abc123  /opt/atlassian/atlassian-crowd.tar.gz' | sha256sum -c -",
+		"FROM base AS crowd-2.12",
+		"curl -o /opt/atlassian/atlassian-crowd.tar.gz -SL 'https://example.com/atlassian-crowd-2.12.0.tar.gz'",
+	} {
+		i := strings.Index(got, want)
+		if i < 0 {
+			t.Errorf("%s is missing %q", cfg.MultiStage, want)
+			continue
+		}
+		if i < last {
+			t.Errorf("%q is out of order in %s", want, cfg.MultiStage)
+		}
+		last = i
+	}
+	if t.Failed() {
+		t.Logf("%s:\n%s", cfg.MultiStage, got)
+	}
+}
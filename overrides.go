@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// overridesFile is the name of the optional file in a version directory that
+// overrides the run's settings for that directory alone. It holds any of the
+// settings a -config file can, such as {"baseImage": "debian:stretch"} or
+// {"templateData": {"proxy": "http://proxy:3128"}}, and they take precedence
+// over the flags, which take precedence over the -config file and the
+// defaults. Maps such as templateData are merged into the run's rather than
+// replacing them.
+const overridesFile = ".crowd-overrides.json"
+
+// loadOverrides reads the overridesFile of each version directory that has
+// one, returning the settings each of those directories is handled with.
+func loadOverrides(versionDirs []string, cfg Config) (map[string]Config, error) {
+	overrides := map[string]Config{}
+	for _, dir := range versionDirs {
+		data, err := ioutil.ReadFile(filepath.Join(dir, overridesFile))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		dcfg := cloneConfig(cfg)
+		if err := json.Unmarshal(data, &dcfg); err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", filepath.Join(dir, overridesFile), err)
+		}
+		debugf("%s has its own settings in %s", dir, overridesFile)
+		overrides[dir] = dcfg
+	}
+	return overrides, nil
+}
+
+// cloneConfig copies cfg deeply enough that decoding JSON into the copy
+// leaves cfg alone: json.Unmarshal adds to existing maps and reuses the
+// backing arrays of existing slices.
+func cloneConfig(cfg Config) Config {
+	cfg.CurrentFeed = append(URLList(nil), cfg.CurrentFeed...)
+	cfg.ArchiveFeed = append(URLList(nil), cfg.ArchiveFeed...)
+	cfg.EAPFeed = append(URLList(nil), cfg.EAPFeed...)
+	cfg.Hold = append([]string(nil), cfg.Hold...)
+	cfg.Variants = append([]Variant(nil), cfg.Variants...)
+	templateData := map[string]string{}
+	for k, v := range cfg.TemplateData {
+		templateData[k] = v
+	}
+	cfg.TemplateData = templateData
+	urlRewrite := map[string]string{}
+	for k, v := range cfg.URLRewrite {
+		urlRewrite[k] = v
+	}
+	cfg.URLRewrite = urlRewrite
+	jdkMap := map[string][]string{}
+	for k, v := range cfg.JDKMap {
+		jdkMap[k] = append([]string(nil), v...)
+	}
+	cfg.JDKMap = jdkMap
+	return cfg
+}
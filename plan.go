@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// The actions a run can take for a version directory. actionUnchanged is
+// only reported by -dry-run -output json, for an update that would change
+// nothing.
+const (
+	actionCreate    = "create"
+	actionUpdate    = "update"
+	actionUnchanged = "unchanged"
+	actionSkip      = "skip"
+	actionPrune     = "prune"
+	actionMissing   = "missing"
+)
+
+// planEntry is what a run is going to do with one version directory. Key is
+// the major.minor the directory is for. Package is only set for creates and
+// updates.
+type planEntry struct {
+	Dir     string
+	Key     string
+	Action  string
+	Package Package
+	Reason  string
+
+	// cfg is set for a directory with an overridesFile to the settings it
+	// is handled with instead of the run's.
+	cfg *Config
+}
+
+// config returns the settings e is handled with: its overrides, or cfg.
+func (e planEntry) config(cfg Config) Config {
+	if e.cfg != nil {
+		return *e.cfg
+	}
+	return cfg
+}
+
+// makePlan works out what to do with each of the existing version directories
+// and, with -create-new, which new ones to make. New directories are made for
+// the resolved versions above the highest existing one, so lines that have
+// been removed are not brought back; in a repository without any version
+// directories every resolved version is created. A directory listed in the
+// config file's directories gets the package for its rule from ruled rather
+// than the version its name implies, and doesn't count towards the highest.
+// The plan is sorted by directory. A directory with overrides is planned with
+// those settings. When degraded, as a feed couldn't be read, nothing is
+// pruned.
+func makePlan(versionDirs []string, versions map[string]Package, ruled map[versionRule]Package, cfg Config, overrides map[string]Config, degraded bool) []planEntry {
+	var plan []planEntry
+	var highest Version
+	var highestDir string
+	existing := map[string]bool{}
+	for _, dir := range versionDirs {
+		e := planEntry{Dir: dir}
+		var p Package
+		var ok bool
+		var since string
+		missing := "can't find url"
+		if r, mapped := cfg.Directories[dir]; mapped {
+			p, ok = ruled[r]
+			// The directory's own name is its key, and so its tag: the
+			// version it resolves to may well be another directory's.
+			e.Key = dir
+			since = string(r)
+			if ok {
+				since = p.Version.MajorMinor()
+			}
+			missing = fmt.Sprintf("nothing in the feeds matches %s", r)
+		} else {
+			key, isVersion := versionKey(dir)
+			if !isVersion {
+				plan = append(plan, planEntry{Dir: dir, Action: actionSkip, Reason: "not a version directory"})
+				continue
+			}
+			existing[key] = true
+			if highest == "" || Version(key).Compare(highest) > 0 {
+				highest, highestDir = Version(key), dir
+			}
+			e.Key, since = key, key
+			p, ok = versions[key]
+		}
+
+		dcfg := cfg
+		if o, ok := overrides[dir]; ok {
+			e.cfg, dcfg = &o, o
+		}
+		switch {
+		case contains(dcfg.Hold, dir):
+			e.Action, e.Reason = actionSkip, "held"
+		case beforeSince(since, dcfg):
+			e.Action, e.Reason = actionSkip, "before -since-version"
+		case dcfg.OnlyExisting && !hasDockerfile(dir, dcfg):
+			e.Action, e.Reason = actionSkip, "no Dockerfile, with -only-existing"
+		case ok && belowFloor(p, dcfg) && dcfg.Prune:
+			e.Action, e.Reason = actionPrune, "below -min-version"
+		case ok && belowFloor(p, dcfg):
+			e.Action, e.Reason = actionSkip, "below -min-version"
+		case ok && p.Channel == channelEAP && dcfg.RejectEAP:
+			e.Action, e.Reason = actionMissing, "only an EAP release is available"
+		case ok:
+			if p.Channel == channelEAP {
+				warnf("eap_release", "%s resolved to %s, which is a pre-release", dir, p)
+			}
+			e.Action, e.Package = actionUpdate, p
+		case dcfg.Prune:
+			e.Action, e.Reason = actionPrune, "not in any feed"
+		default:
+			e.Action, e.Reason = actionMissing, missing
+		}
+		// What a feed that couldn't be read would have had is unknown, so
+		// nothing is pruned on the strength of the others.
+		if e.Action == actionPrune && degraded {
+			e.Action, e.Reason = actionSkip, "not pruned ("+e.Reason+") with a feed unavailable"
+		}
+		plan = append(plan, e)
+	}
+
+	if cfg.CreateNew {
+		for key, p := range versions {
+			if existing[key] || belowFloor(p, cfg) || beforeSince(key, cfg) {
+				continue
+			}
+			if highest != "" && Version(key).Compare(highest) <= 0 {
+				continue
+			}
+			dir, ok := newVersionDir(key, highestDir)
+			if !ok {
+				warnf("bad_directory_name", "not creating %s: it doesn't match -version-pattern", dir)
+				continue
+			}
+			plan = append(plan, planEntry{Dir: dir, Key: key, Action: actionCreate, Package: p})
+		}
+	}
+
+	sort.Slice(plan, func(i, j int) bool { return plan[i].Dir < plan[j].Dir })
+	return plan
+}
+
+// versionKey returns the major.minor, or with -group-by-patch the full
+// version, that the version directory dir is for, taken from the first capture
+// group of versionDirPattern. A name that only matches with that group empty,
+// or without it taking part, isn't a version directory.
+func versionKey(dir string) (string, bool) {
+	m := versionDirPattern.FindStringSubmatch(dir)
+	if m == nil || m[1] == "" {
+		return "", false
+	}
+	return m[1], true
+}
+
+// newVersionDir names the directory for a new version key after an existing
+// version directory, model, so that "crowd-2.11" leads to "crowd-2.12". The
+// name is only usable if it maps back to key. A model whose first capture group
+// doesn't take part leaves the key itself as the name.
+func newVersionDir(key, model string) (string, bool) {
+	dir := key
+	if m := versionDirPattern.FindStringSubmatchIndex(model); m != nil && m[2] >= 0 {
+		dir = model[:m[2]] + key + model[m[3]:]
+	}
+	k, ok := versionKey(dir)
+	return dir, ok && k == key
+}
+
+// belowFloor reports whether p is older than the -min-version floor. Those
+// versions are no longer maintained: they are never created and their
+// directories are left alone, or removed with -prune.
+func belowFloor(p Package, cfg Config) bool {
+	return cfg.MinVersion != "" && p.Version.Compare(cfg.MinVersion) < 0
+}
+
+// beforeSince reports whether the version directory key is older than
+// -since-version. Unlike those below the -min-version floor, such directories
+// are only left out of this run.
+func beforeSince(key string, cfg Config) bool {
+	return cfg.SinceVersion != "" && Version(key).Compare(cfg.SinceVersion) < 0
+}
+
+// hasDockerfile reports whether the version directory dir already has a
+// Dockerfile, or with variants whether any of its variant subdirectories do.
+func hasDockerfile(dir string, cfg Config) bool {
+	var names []string
+	for _, v := range cfg.Variants {
+		names = append(names, filepath.Join(dir, v.Name, "Dockerfile"))
+	}
+	if len(names) == 0 {
+		names = []string{filepath.Join(dir, "Dockerfile")}
+	}
+	for _, name := range names {
+		if _, err := os.Stat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// plannedAction is the -dry-run -output json record of a planEntry.
+type plannedAction struct {
+	Dir     string  `json:"dir"`
+	Action  string  `json:"action"`
+	Version Version `json:"version,omitempty"`
+	URL     string  `json:"url,omitempty"`
+	Reason  string  `json:"reason,omitempty"`
+}
+
+// writePlanJSON writes the plan for -dry-run -output json, in directory order.
+// An update that wouldn't change any file is given as "unchanged"; without
+// the downloads, one that needs -checksum always counts as changed.
+func writePlanJSON(w io.Writer, plan []planEntry, cfg Config) error {
+	actions := []plannedAction{}
+	for _, e := range plan {
+		a := plannedAction{
+			Dir:     filepath.ToSlash(e.Dir),
+			Action:  e.Action,
+			Version: e.Package.Version,
+			URL:     e.Package.ZipURL,
+			Reason:  e.Reason,
+		}
+		if ecfg := e.config(cfg); e.Action == actionUpdate && !ecfg.Checksum {
+			if d, err := drifted(e, ecfg); err == nil && !d {
+				a.Action = actionUnchanged
+			}
+		}
+		actions = append(actions, a)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(actions)
+}
+
+// printPlan writes the plan as a table for -dry-run.
+func printPlan(w io.Writer, plan []planEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, e := range plan {
+		if e.Package.ZipURL != "" {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", e.Action, filepath.ToSlash(e.Dir), e.Package.Version, e.Package.ZipURL)
+		} else {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Action, filepath.ToSlash(e.Dir), e.Reason)
+		}
+	}
+	return tw.Flush()
+}
+
+// checkNoEAP fails for -no-eap-in-directories when any existing version
+// directory in the plan is to be updated to a release from the EAP feed,
+// naming every one of them.
+func checkNoEAP(plan []planEntry) error {
+	var dirs []string
+	for _, e := range plan {
+		if e.Action == actionUpdate && e.Package.Channel == channelEAP {
+			dirs = append(dirs, fmt.Sprintf("%s (%s)", filepath.ToSlash(e.Dir), e.Package.Version))
+		}
+	}
+	if len(dirs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("with -no-eap-in-directories, these version directories resolved to EAP releases: %s", strings.Join(dirs, ", "))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+// withVersionPattern runs the rest of the test with pattern as the
+// -version-pattern.
+func withVersionPattern(t *testing.T, pattern string) {
+	t.Helper()
+	saved := versionDirPattern
+	versionDirPattern = regexp.MustCompile(pattern)
+	t.Cleanup(func() { versionDirPattern = saved })
+}
+
+func TestVersionKey(t *testing.T) {
+	withVersionPattern(t, `^([0-9]+\.[0-9]+)$|^crowd-([0-9]+\.[0-9]+)$`)
+	for _, tt := range []struct {
+		dir  string
+		key  string
+		isOK bool
+	}{
+		{"2.11", "2.11", true},
+		{"crowd-2.11", "", false},
+		{"templates", "", false},
+	} {
+		key, ok := versionKey(tt.dir)
+		if key != tt.key || ok != tt.isOK {
+			t.Errorf("versionKey(%q) = %q, %t, want %q, %t", tt.dir, key, ok, tt.key, tt.isOK)
+		}
+	}
+}
+
+func TestNewVersionDir(t *testing.T) {
+	for _, tt := range []struct {
+		pattern string
+		model   string
+		dir     string
+		isOK    bool
+	}{
+		{defaultVersionPattern, "2.11", "2.12", true},
+		{`^crowd-([0-9]+\.[0-9]+)$`, "crowd-2.11", "crowd-2.12", true},
+		{`^(x)?([0-9]+\.[0-9]+)$`, "2.11", "2.12", false},
+	} {
+		withVersionPattern(t, tt.pattern)
+		dir, ok := newVersionDir("2.12", tt.model)
+		if dir != tt.dir || ok != tt.isOK {
+			t.Errorf("with %s, newVersionDir(2.12, %q) = %q, %t, want %q, %t", tt.pattern, tt.model, dir, ok, tt.dir, tt.isOK)
+		}
+	}
+}
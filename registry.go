@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// manifestTypes are the manifest media types asked for when checking a tag, so
+// registries answer for both Docker and OCI images.
+var manifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// registryCheck writes whether each tag the plan would build is already
+// published to the -registry-check repository, such as
+// https://registry.example.com/v2/mycorp/crowd. With -registry-provenance a
+// published tag is reported as drifted when its image was built from a
+// different tarball than the one resolved now. Nothing is ever pushed, and a
+// tag the registry can't answer for is reported as unknown with a warning
+// rather than failing the run.
+func registryCheck(ctx context.Context, w io.Writer, f *fetcher, plan []planEntry, cfg Config) error {
+	base := strings.TrimSuffix(cfg.RegistryCheck, "/")
+	cfg.TagPrefix = ""
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, e := range plan {
+		if e.Action != actionCreate && e.Action != actionUpdate {
+			continue
+		}
+		ecfg := e.config(cfg)
+		ecfg.TagPrefix = ""
+		for _, t := range targets(e, ecfg) {
+			for _, tag := range tags(t, ecfg) {
+				url := base + "/manifests/" + tag
+				status := "unpublished"
+				published, err := f.manifestExists(ctx, url)
+				switch {
+				case err != nil:
+					warnf("registry_check", "can't check %s: %s", url, err)
+					status = "unknown"
+				case published:
+					status = "published"
+				}
+				var detail string
+				if published && cfg.RegistryProvenance {
+					labels, err := f.imageLabels(ctx, base, tag)
+					if err != nil {
+						warnf("registry_check", "can't read the labels of %s: %s", url, err)
+					} else if detail = provenanceDrift(labels, t.data.Package); detail != "" {
+						status = "drifted"
+					}
+				}
+				if detail != "" {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", status, filepath.ToSlash(t.dir), tag, detail)
+				} else {
+					fmt.Fprintf(tw, "%s\t%s\t%s\n", status, filepath.ToSlash(t.dir), tag)
+				}
+			}
+		}
+	}
+	return tw.Flush()
+}
+
+// manifestExists reports whether a HEAD request for the manifest at url finds
+// it. Any answer other than found or not found is an error.
+func (f *fetcher) manifestExists(ctx context.Context, url string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	resp, err := f.do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("HEAD returned %s", resp.Status)
+}
+
+// The labels Dockerfile.tmpl records the version and the tarball an image was
+// built from in.
+const (
+	versionLabel = "org.opencontainers.image.version"
+	zipURLLabel  = "com.github.nkatsaros.crowd.zip-url"
+	sha256Label  = "com.github.nkatsaros.crowd.sha256"
+)
+
+// provenanceDrift describes how the labels of a published image show it was
+// built from something other than p, or returns "" if they match. Images
+// without the labels can't be compared and aren't reported.
+func provenanceDrift(labels map[string]string, p Package) string {
+	if u := labels[zipURLLabel]; u != "" && u != p.ZipURL {
+		return "built from " + u
+	}
+	if sum := labels[sha256Label]; sum != "" && p.SHA256 != "" && sum != p.SHA256 {
+		return "built from a tarball with SHA-256 " + sum
+	}
+	return ""
+}
+
+// manifest is the part of an image manifest or index that imageLabels needs.
+type manifest struct {
+	Annotations map[string]string `json:"annotations"`
+	Config      struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// imageLabels returns the labels of the image tagged tag in the repository
+// at base, along with any annotations on its manifest. For a multi-platform
+// index the first image is read, since every platform is built from the same
+// tarball.
+func (f *fetcher) imageLabels(ctx context.Context, base, tag string) (map[string]string, error) {
+	var m manifest
+	if err := f.getRegistryJSON(ctx, base+"/manifests/"+tag, &m); err != nil {
+		return nil, err
+	}
+	if len(m.Manifests) > 0 {
+		if err := f.getRegistryJSON(ctx, base+"/manifests/"+m.Manifests[0].Digest, &m); err != nil {
+			return nil, err
+		}
+	}
+	var config struct {
+		Config struct {
+			Labels map[string]string `json:"Labels"`
+		} `json:"config"`
+	}
+	if m.Config.Digest != "" {
+		if err := f.getRegistryJSON(ctx, base+"/blobs/"+m.Config.Digest, &config); err != nil {
+			return nil, err
+		}
+	}
+	labels := map[string]string{}
+	for k, v := range config.Config.Labels {
+		labels[k] = v
+	}
+	for k, v := range m.Annotations {
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// getRegistryJSON decodes the JSON document at url into v.
+func (f *fetcher) getRegistryJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+	resp, err := f.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
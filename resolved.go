@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// resolvedFormat is part of every resolution key, so the cached results are
+// thrown away whenever the way versions are resolved changes.
+const resolvedFormat = 3
+
+// resolvedPackage is how a resolved Package is saved in the -cache-dir, with
+// the fields the feeds' own JSON leaves out.
+type resolvedPackage struct {
+	ZipURL   string    `json:"zipUrl"`
+	Version  Version   `json:"version"`
+	Released time.Time `json:"released"`
+	Latest   bool      `json:"latest"`
+	Channel  string    `json:"channel"`
+	Source   string    `json:"source"`
+	Artifact string    `json:"artifact"`
+	Edition  string    `json:"edition,omitempty"`
+	Type     string    `json:"type,omitempty"`
+	Platform string    `json:"platform,omitempty"`
+}
+
+func newResolvedPackage(p Package) resolvedPackage {
+	return resolvedPackage{
+		ZipURL:   p.ZipURL,
+		Version:  p.Version,
+		Released: time.Time(p.Released),
+		Latest:   p.Latest,
+		Channel:  p.Channel,
+		Source:   p.Source,
+		Artifact: p.Artifact,
+		Edition:  p.Edition,
+		Type:     p.Type,
+		Platform: p.Platform,
+	}
+}
+
+func (r resolvedPackage) pkg() Package {
+	return Package{
+		ZipURL:   r.ZipURL,
+		Version:  r.Version,
+		Released: AtlassianTime(r.Released),
+		Latest:   r.Latest,
+		Channel:  r.Channel,
+		Source:   r.Source,
+		Artifact: r.Artifact,
+		Edition:  r.Edition,
+		Type:     r.Type,
+		Platform: r.Platform,
+	}
+}
+
+// resolvedFile is the file the resolved versions, and the packages for the
+// rules of the config file's directories, are saved in, with the full key
+// they were resolved for.
+type resolvedFile struct {
+	Key      string                          `json:"key"`
+	Versions map[string]resolvedPackage      `json:"versions"`
+	Rules    map[versionRule]resolvedPackage `json:"rules,omitempty"`
+}
+
+// resolutionKey hashes everything getVersions' result depends on: the body of
+// every feed URL in order along with its channel, and the settings that change
+// which entries are kept or how their dates are read.
+func (f *fetcher) resolutionKey(fetched []feedEntries) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "format %d\nwar %t\ndepth %d\npatch %t\neditions %t\ntimezone %s\n", resolvedFormat, f.includeWar, f.groupDepth, f.groupByPatch, f.separateEditions, feedLocation)
+	for _, r := range f.rules {
+		fmt.Fprintf(h, "rule %s\n", r)
+	}
+	if !f.stableCutoff.IsZero() {
+		// Release dates are midnight in feedLocation, so only the cutoff's day
+		// there changes which releases count as stable.
+		fmt.Fprintf(h, "stable before %s\n", f.stableCutoff.In(feedLocation).Format("2006-01-02"))
+	}
+	for _, fe := range fetched {
+		fmt.Fprintf(h, "%s %s %d\n", fe.feed.Channel, fe.url, len(fe.body))
+		h.Write(fe.body)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (f *fetcher) resolvedPath(key string) string {
+	return filepath.Join(f.cacheDir, "resolved-"+key[:16]+".json")
+}
+
+// loadResolved returns the versions and rule packages saved for key by an
+// earlier run. There are none without a -cache-dir, and an unreadable file is
+// treated as a miss.
+func (f *fetcher) loadResolved(key string) (map[string]Package, map[versionRule]Package, bool) {
+	if f.cacheDir == "" {
+		return nil, nil, false
+	}
+	data, err := ioutil.ReadFile(f.resolvedPath(key))
+	if err != nil {
+		return nil, nil, false
+	}
+	var saved resolvedFile
+	if err := json.Unmarshal(data, &saved); err != nil || saved.Key != key {
+		return nil, nil, false
+	}
+	versions := map[string]Package{}
+	for k, r := range saved.Versions {
+		versions[k] = r.pkg()
+	}
+	ruled := map[versionRule]Package{}
+	for r, rp := range saved.Rules {
+		ruled[r] = rp.pkg()
+	}
+	return versions, ruled, true
+}
+
+// saveResolved saves versions and ruled under key in the -cache-dir, if there
+// is one, replacing whatever was saved for earlier feed bodies.
+func (f *fetcher) saveResolved(key string, versions map[string]Package, ruled map[versionRule]Package) error {
+	if f.cacheDir == "" {
+		return nil
+	}
+	saved := resolvedFile{Key: key, Versions: map[string]resolvedPackage{}}
+	for k, p := range versions {
+		saved.Versions[k] = newResolvedPackage(p)
+	}
+	if len(ruled) > 0 {
+		saved.Rules = map[versionRule]resolvedPackage{}
+		for r, p := range ruled {
+			saved.Rules[r] = newResolvedPackage(p)
+		}
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(f.cacheDir, 0755); err != nil {
+		return err
+	}
+	old, _ := filepath.Glob(filepath.Join(f.cacheDir, "resolved-*.json"))
+	for _, name := range old {
+		os.Remove(name)
+	}
+	return writeFileAtomic(f.resolvedPath(key), data, 0644, f.fsync)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+)
+
+// versionResult is the -output json record of a version directory that was
+// created or changed, with enough to describe the change in a pull request.
+type versionResult struct {
+	Dir             string  `json:"dir"`
+	Action          string  `json:"action"`
+	PreviousVersion Version `json:"previousVersion,omitempty"`
+	Version         Version `json:"version"`
+	PreviousURL     string  `json:"previousUrl,omitempty"`
+	URL             string  `json:"url"`
+	Released        string  `json:"released"`
+	Channel         string  `json:"channel"`
+}
+
+// changedResults lists a versionResult for every directory in the plan that
+// update changed, in plan order.
+func changedResults(plan []planEntry, results []dirResult) []versionResult {
+	changed := []versionResult{}
+	for i, e := range plan {
+		res := results[i]
+		if res.err != nil || !res.updated.Changed {
+			continue
+		}
+		changed = append(changed, versionResult{
+			Dir:             filepath.ToSlash(e.Dir),
+			Action:          e.Action,
+			PreviousVersion: res.updated.PreviousVersion,
+			Version:         e.Package.Version,
+			PreviousURL:     res.updated.PreviousURL,
+			URL:             e.Package.ZipURL,
+			Released:        time.Time(e.Package.Released).Format("2006-01-02"),
+			Channel:         e.Package.Channel,
+		})
+	}
+	return changed
+}
+
+func writeResults(w io.Writer, changed []versionResult) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(changed)
+}
+
+// previousPackage reads the version and tarball URL the Dockerfile in dir was
+// generated for.
+func previousPackage(dir string) (Version, string) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, "Dockerfile"))
+	if err != nil {
+		return "", ""
+	}
+	var v Version
+	var url string
+	if m := dockerfileVersion.FindSubmatch(data); m != nil {
+		v = Version(m[1])
+	} else if m := dockerfileEnvVersion.FindSubmatch(data); m != nil {
+		v = Version(m[1])
+	}
+	if m := dockerfileZipURL.FindSubmatch(data); m != nil {
+		url = string(m[1])
+	}
+	return v, url
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// scaffold creates the directory for a new version and fills it from the files
+// in templateDir. Files ending in .tmpl are executed like Dockerfile.tmpl and
+// written without the suffix; everything else is copied as is. Without a
+// templateDir the directory gets the usual Dockerfile and entrypoint. The
+// directory is made in the -out-dir if there is one.
+func scaffold(e planEntry, templateDir string, cfg Config) error {
+	dir := filepath.Join(cfg.OutDir, e.Dir)
+	entries, err := os.ReadDir(templateDir)
+	noTemplates := os.IsNotExist(err)
+	if err != nil && !noTemplates {
+		return err
+	}
+	if cfg.OutDir != "" {
+		if err := os.MkdirAll(cfg.OutDir, 0755); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return err
+	}
+	if noTemplates {
+		_, err := update(e, cfg)
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		src := filepath.Join(templateDir, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		data, err := scaffoldFile(src, e.Package, cfg)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dir, strings.TrimSuffix(entry.Name(), ".tmpl"))
+		if err := writeFileAtomic(dst, data, info.Mode().Perm(), cfg.Fsync); err != nil {
+			return err
+		}
+		if err := chownGenerated(dst, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scaffoldFile returns what scaffold writes for the template file src: the
+// file as it is, or executed with p if it ends in .tmpl.
+func scaffoldFile(src string, p Package, cfg Config) ([]byte, error) {
+	if !strings.HasSuffix(src, ".tmpl") {
+		return ioutil.ReadFile(src)
+	}
+	t, err := template.ParseFiles(src)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, newTemplateData(p, Variant{}, cfg)); err != nil {
+		return nil, fmt.Errorf("executing %s: %w", src, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// scaffoldFiles lists the names of the files scaffold writes into a version
+// directory from templateDir, none if there is no templateDir.
+func scaffoldFiles(templateDir string) ([]string, error) {
+	entries, err := os.ReadDir(templateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			names = append(names, strings.TrimSuffix(entry.Name(), ".tmpl"))
+		}
+	}
+	return names, nil
+}
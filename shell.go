@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// renderShellVersions returns the resolved versions as a file a shell can
+// source: CROWD_<key>_VERSION and CROWD_<key>_URL for every version key, with
+// anything but letters and digits in the key made an underscore, and
+// CROWD_LATEST, CROWD_LATEST_VERSION and CROWD_LATEST_URL for the highest
+// version marked latest, if any is. With editions, that's the highest of the
+// standard edition, the one tagged plain latest. The version keys are listed
+// in the order, asc or desc.
+func renderShellVersions(versions map[string]Package, editions bool, order string) []byte {
+	var keys []string
+	for key := range versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sort.SliceStable(keys, func(i, j int) bool { return versionsInOrder(Version(keys[i]), Version(keys[j]), order) })
+
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by update.go from the Atlassian feeds, any changes will be overwritten.\n")
+	var latest string
+	for _, key := range keys {
+		p := versions[key]
+		name := "CROWD_" + shellName(key)
+		fmt.Fprintf(&buf, "%s_VERSION=%s\n", name, shellQuote(string(p.Version)))
+		fmt.Fprintf(&buf, "%s_URL=%s\n", name, shellQuote(p.ZipURL))
+		if p.Latest && !(editions && p.Edition != "") && (latest == "" || p.Version.Compare(versions[latest].Version) > 0) {
+			latest = key
+		}
+	}
+	if latest != "" {
+		p := versions[latest]
+		fmt.Fprintf(&buf, "CROWD_LATEST=%s\n", shellQuote(latest))
+		fmt.Fprintf(&buf, "CROWD_LATEST_VERSION=%s\n", shellQuote(string(p.Version)))
+		fmt.Fprintf(&buf, "CROWD_LATEST_URL=%s\n", shellQuote(p.ZipURL))
+	}
+	return buf.Bytes()
+}
+
+// shellName turns a version key such as 5.1 or 5.1-dc into 5_1 or 5_1_DC for
+// use in a shell variable name.
+func shellName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		}
+		return '_'
+	}, key)
+}
+
+// shellQuote single-quotes s for a shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
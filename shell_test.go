@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+// TestRenderShellVersions covers the order of the keys, where a -dc key comes
+// just below its plain one as Compare puts "dc" below the missing 0, and which
+// key is latest with and without editions.
+func TestRenderShellVersions(t *testing.T) {
+	versions := map[string]Package{
+		"2.10":    {Version: "2.10.3", ZipURL: "https://example.com/atlassian-crowd-2.10.3.tar.gz"},
+		"2.11":    {Version: "2.11.1", ZipURL: "https://example.com/atlassian-crowd-2.11.1.tar.gz", Latest: true},
+		"2.11-dc": {Version: "2.11.2", ZipURL: "https://example.com/it's-2.11.2.tar.gz", Latest: true, Edition: editionDataCenter},
+	}
+	const header = "# Generated by update.go from the Atlassian feeds, any changes will be overwritten.\n"
+	for _, tt := range []struct {
+		name     string
+		editions bool
+		order    string
+		want     string
+	}{
+		{"ascending", true, "asc", header +
+			"CROWD_2_10_VERSION='2.10.3'\n" +
+			"CROWD_2_10_URL='https://example.com/atlassian-crowd-2.10.3.tar.gz'\n" +
+			"CROWD_2_11_DC_VERSION='2.11.2'\n" +
+			"CROWD_2_11_DC_URL='https://example.com/it'\\''s-2.11.2.tar.gz'\n" +
+			"CROWD_2_11_VERSION='2.11.1'\n" +
+			"CROWD_2_11_URL='https://example.com/atlassian-crowd-2.11.1.tar.gz'\n" +
+			"CROWD_LATEST='2.11'\n" +
+			"CROWD_LATEST_VERSION='2.11.1'\n" +
+			"CROWD_LATEST_URL='https://example.com/atlassian-crowd-2.11.1.tar.gz'\n"},
+		{"descending without editions", false, "desc", header +
+			"CROWD_2_11_VERSION='2.11.1'\n" +
+			"CROWD_2_11_URL='https://example.com/atlassian-crowd-2.11.1.tar.gz'\n" +
+			"CROWD_2_11_DC_VERSION='2.11.2'\n" +
+			"CROWD_2_11_DC_URL='https://example.com/it'\\''s-2.11.2.tar.gz'\n" +
+			"CROWD_2_10_VERSION='2.10.3'\n" +
+			"CROWD_2_10_URL='https://example.com/atlassian-crowd-2.10.3.tar.gz'\n" +
+			"CROWD_LATEST='2.11-dc'\n" +
+			"CROWD_LATEST_VERSION='2.11.2'\n" +
+			"CROWD_LATEST_URL='https://example.com/it'\\''s-2.11.2.tar.gz'\n"},
+	} {
+		if got := string(renderShellVersions(versions, tt.editions, tt.order)); got != tt.want {
+			t.Errorf("%s: got\n%s\nwant\n%s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+)
+
+// feedsUnchanged reports whether the -newer-than-file stamp name holds key,
+// the resolution key of the feeds just read. A missing stamp is a change.
+func feedsUnchanged(name, key string) (bool, error) {
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(bytes.TrimSpace(data)) == key, nil
+}
+
+// writeStamp records key in the -newer-than-file stamp name once a run has
+// succeeded.
+func writeStamp(name, key string, cfg Config) error {
+	return writeFileAtomic(name, []byte(key+"\n"), 0644, cfg.Fsync)
+}
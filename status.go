@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+// runSummary counts what was done to the version directories, for the status
+// line.
+type runSummary struct {
+	changed int
+	created int
+	pruned  int
+	failed  int
+	// unavailable is how many feed URLs were left out as unreadable.
+	unavailable int
+}
+
+// summary is filled in by run once every version directory has been handled.
+var summary runSummary
+
+// warnings counts every warning printed by warnf.
+var warnings atomic.Int64
+
+// count adds up the results of handling each of the version directories in
+// the plan.
+func (s *runSummary) count(plan []planEntry, results []dirResult) {
+	for i, res := range results {
+		switch {
+		case res.err != nil:
+			s.failed++
+		case res.pruned:
+			s.pruned++
+		case res.updated.Changed:
+			s.changed++
+			if plan[i].Action == actionCreate {
+				s.created++
+			}
+		}
+	}
+}
+
+// statusLine describes how the run that returned err went in one line of
+// key=value pairs for monitoring to scrape. The status is ok, error, timeout
+// or, for a run that left out a feed it couldn't read, degraded. errors
+// counts those feeds as well as the failed directories, and is at least 1
+// whenever the status isn't ok. The keys and their order are not to change.
+func statusLine(err error) string {
+	status, failed := "ok", summary.failed+summary.unavailable
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		status = "timeout"
+	case err != nil:
+		status = "error"
+	case summary.unavailable > 0:
+		status = "degraded"
+	}
+	if err != nil {
+		failed = max(failed, 1)
+	}
+	return fmt.Sprintf("status=%s changed=%d created=%d pruned=%d warnings=%d errors=%d",
+		status, summary.changed, summary.created, summary.pruned, warnings.Load(), failed)
+}
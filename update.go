@@ -2,17 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 	"time"
 )
@@ -23,145 +26,1442 @@ const (
 	eapUrl     = `https://my.atlassian.com/download/feeds/eap/crowd.json`
 )
 
-var tmpl = template.Must(template.ParseFiles("Dockerfile.tmpl"))
+// defaultVersionPattern matches version directories named for a bare
+// major.minor such as "2.11", and patchVersionPattern, used instead with
+// -group-by-patch, ones named for a full version such as "2.11.1".
+const (
+	defaultVersionPattern = `^([0-9]+\.[0-9]+)$`
+	patchVersionPattern   = `^([0-9]+\.[0-9]+\.[0-9]+([.-][0-9A-Za-z]+)*)$`
+)
+
+// versionPatternFor returns the pattern used in place of defaultVersionPattern
+// for the grouping cfg asks for: the full version with -group-by-patch,
+// otherwise -group-depth components, with an optional "-dc" for
+// -separate-editions.
+func versionPatternFor(cfg Config) string {
+	if cfg.GroupByPatch {
+		return patchVersionPattern
+	}
+	pattern := `[0-9]+` + strings.Repeat(`\.[0-9]+`, cfg.GroupDepth-1)
+	if cfg.SeparateEditions {
+		pattern += `(-dc)?`
+	}
+	return "^(" + pattern + ")$"
+}
+
+// tmpl is parsed from Dockerfile.tmpl at the start of a run.
+var tmpl *template.Template
+
+// All of the regular expressions are compiled once here rather than where
+// they are used.
+var (
+	// versionSeparator splits a version such as "2.11.1" or "2.12-m01" into
+	// its components.
+	versionSeparator = regexp.MustCompile(`(\.|-)`)
+
+	// versionDirPattern matches the names of version directories, capturing
+	// the major.minor, or with -group-by-patch the version, they are for. It
+	// is replaced by -version-pattern.
+	versionDirPattern = regexp.MustCompile(defaultVersionPattern)
+
+	// unsafeCacheChars matches the runs of characters in a feed URL that are
+	// replaced to make its cache file name.
+	unsafeCacheChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+	// usableVersion matches a feed entry's version that has at least a
+	// major.minor.
+	usableVersion = regexp.MustCompile(`^[0-9]+\.[0-9]+([.-][0-9A-Za-z]+)*$`)
+
+	// dockerfileVersion, dockerfileZipURL and dockerfileEnvVersion capture
+	// the version and tarball URL a Dockerfile generated earlier was for,
+	// from its labels or, for one that predates them, its CROWD_VERSION.
+	dockerfileVersion    = regexp.MustCompile(regexp.QuoteMeta(versionLabel) + `="([^"]*)"`)
+	dockerfileZipURL     = regexp.MustCompile(regexp.QuoteMeta(zipURLLabel) + `="([^"]*)"`)
+	dockerfileEnvVersion = regexp.MustCompile(`(?m)^ENV CROWD_VERSION[ =](\S+)`)
+
+	// filenameVersion captures the version in a tarball's filename, such as
+	// the 5.1.3 of atlassian-crowd-5.1.3.tar.gz.
+	filenameVersion = regexp.MustCompile(`-([0-9]+\.[0-9]+(\.[0-9]+)*)[.-]`)
+
+	// secretKey matches the names of -template-data keys whose values are
+	// redacted by -print-config.
+	secretKey = regexp.MustCompile(`(?i)(password|passwd|secret|token|credential|auth|key)`)
+
+	// wildcardRule matches the versionRules for the latest of a major or
+	// minor.
+	wildcardRule = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?\.x$`)
+)
+
+// errNoPackages is returned when every entry in the feeds was filtered out,
+// which points at a problem with the feeds rather than any one directory.
+var errNoPackages = errors.New("the atlassian feeds returned no matching tar.gz packages")
+
+// exitTimeout is the exit code used when the run is stopped by -timeout.
+const exitTimeout = 3
 
 func main() {
-	versionDirs, err := getDirs(".")
+	cfg, err := parseConfig(os.Args[1:])
 	if err != nil {
-		fmt.Println("error fetching version dirs:", err)
+		fmt.Fprintln(os.Stderr, "error reading config:", err)
+		os.Exit(1)
+	}
+	setupLogging(cfg)
+	if feedLocation, err = time.LoadLocation(cfg.FeedTimezone); err != nil {
+		fmt.Fprintln(os.Stderr, "error reading config:", err)
+		os.Exit(1)
+	}
+	if versionDirPattern, err = regexp.Compile(cfg.VersionPattern); err != nil {
+		fmt.Fprintln(os.Stderr, "error reading config:", err)
+		os.Exit(1)
+	}
+	if versionDirPattern.NumSubexp() < 1 {
+		fmt.Fprintln(os.Stderr, "error reading config: -version-pattern needs a capture group for the version")
 		os.Exit(1)
 	}
 
-	versions, err := getVersions(currentUrl, archiveUrl, eapUrl)
+	ctx := context.Background()
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.Timeout))
+		defer cancel()
+	}
+	err = run(ctx, cfg)
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Fprintln(os.Stderr, "run timed out after", cfg.Timeout)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	// The status line comes last, so monitoring only has to read one line.
+	// It goes to stdout, other than in the modes where stdout is data.
+	if !cfg.Quiet {
+		statusOut := os.Stdout
+		if cfg.Output == "json" || cfg.PrintConfig || cfg.ListChanged {
+			statusOut = os.Stderr
+		}
+		fmt.Fprintln(statusOut, statusLine(err))
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		os.Exit(exitTimeout)
+	}
 	if err != nil {
-		fmt.Println("error reading atlassian feeds:", err)
 		os.Exit(1)
 	}
+}
 
-	for _, dir := range versionDirs {
-		p, ok := versions[dir]
+func run(ctx context.Context, cfg Config) (err error) {
+	if cfg.PrintConfig {
+		return printConfig(os.Stdout, cfg)
+	}
+	if cfg.Validate {
+		return validate(ctx, cfg)
+	}
+	if cfg.ValidateTemplate {
+		return validateTemplate(cfg)
+	}
+	if cfg.Explain != "" {
+		return explain(ctx, os.Stdout, newFetcher(cfg), cfg.feeds(), cfg.Explain)
+	}
+	if cfg.Coverage {
+		return coverage(ctx, os.Stdout, newFetcher(cfg), cfg.feeds())
+	}
+	if len(cfg.CompareWith) == 2 {
+		return compareSnapshots(ctx, os.Stdout, cfg.CompareWith[0], cfg.CompareWith[1], cfg)
+	}
+	if cfg.FetchOnly {
+		return newFetcher(cfg).fetchOnly(ctx, os.Stdout, cfg.feeds())
+	}
+
+	if !cfg.Force {
+		if err := looksLikeRepoRoot(cfg); err != nil {
+			return err
+		}
+	}
+	if tmpl, err = template.ParseFiles("Dockerfile.tmpl"); err != nil {
+		return err
+	}
+	if !cfg.NoEntrypoint {
+		if err := checkEntrypointSource(cfg.EntrypointSrc); err != nil {
+			return err
+		}
+	}
+
+	versionDirs, err := getDirs(".")
+	if err != nil {
+		return fmt.Errorf("error fetching version dirs: %w", err)
+	}
+	if cfg.SyncEntrypoint {
+		return syncEntrypoints(versionDirs, cfg)
+	}
+	if cfg.Audit {
+		return audit(versionDirs, cfg)
+	}
+
+	f := newFetcher(cfg)
+	var lock map[string]Version
+	if cfg.Lock != "" && !cfg.UpdateLock {
+		if lock, err = loadLock(cfg.Lock); err != nil {
+			return err
+		}
+		f.rules = versionRules(cfg.Directories, lockRules(lock)...)
+	}
+	versions, ruled, err := f.getVersions(ctx, cfg.feeds())
+	if err != nil {
+		return fmt.Errorf("error reading atlassian feeds: %w", err)
+	}
+	if len(versions) == 0 {
+		return errNoPackages
+	}
+	summary.unavailable = f.unavailable
+	if cfg.NewerThanFile != "" && !cfg.Force {
+		unchanged, err := feedsUnchanged(cfg.NewerThanFile, f.feedsKey)
+		if err != nil {
+			return fmt.Errorf("error reading %s: %w", cfg.NewerThanFile, err)
+		}
+		if unchanged {
+			infof("feeds unchanged since the last successful run")
+			return nil
+		}
+	}
+	if cfg.UpdateLock {
+		if f.unavailable > 0 {
+			return fmt.Errorf("not updating %s: %d of the feed URLs couldn't be read", cfg.Lock, f.unavailable)
+		}
+		return updateLock(cfg.Lock, versions, cfg)
+	}
+	if lock != nil {
+		if err := applyLock(versions, ruled, lock, cfg.Lock); err != nil {
+			return err
+		}
+	}
+	if err := checkReleaseDates(versions, time.Now(), cfg); err != nil {
+		return err
+	}
+	if err := checkMaxAge(versions, time.Now(), cfg); err != nil {
+		return err
+	}
+	if cfg.EAPTag != "" {
+		markLatestEAP(versions)
+	}
+	if cfg.NoLatest {
+		for k, p := range versions {
+			p.Latest = false
+			versions[k] = p
+		}
+	}
+	if cfg.ShellVersions != "" {
+		return writeFileAtomic(cfg.ShellVersions, renderShellVersions(versions, cfg.SeparateEditions, cfg.Sort), 0644, cfg.Fsync)
+	}
+	// A rule's package picks up the markings of the same package resolved
+	// for its version key.
+	for r, p := range ruled {
+		if v, ok := versions[f.groupKey(p)]; ok && v.ZipURL == p.ZipURL {
+			ruled[r] = v
+		} else if cfg.NoLatest {
+			p.Latest = false
+			ruled[r] = p
+		}
+	}
+
+	if cfg.Scaffold != "" {
+		p, ok := versions[cfg.Scaffold]
 		if !ok {
-			fmt.Println("can't find url for version", dir)
-			os.Exit(1)
+			return fmt.Errorf("can't find url for version %s", cfg.Scaffold)
+		}
+		e := planEntry{Dir: cfg.Scaffold, Key: cfg.Scaffold, Action: actionCreate, Package: p}
+		if err := scaffold(e, cfg.ScaffoldTemplates, cfg); err != nil {
+			return fmt.Errorf("error scaffolding %s: %w", cfg.Scaffold, err)
+		}
+		infof("created %s", cfg.Scaffold)
+		return nil
+	}
+
+	overrides, err := loadOverrides(versionDirs, cfg)
+	if err != nil {
+		return err
+	}
+	plan := makePlan(versionDirs, versions, ruled, cfg, overrides, f.unavailable > 0)
+	if cfg.LatestPerMajor {
+		markLatestPerMajor(plan, cfg.SeparateEditions)
+	}
+	if cfg.NoEAPInDirectories {
+		if err := checkNoEAP(plan); err != nil {
+			return err
+		}
+	}
+	if cfg.DryRun && cfg.Output == "json" {
+		return writePlanJSON(os.Stdout, plan, cfg)
+	}
+	if cfg.DryRun {
+		return printPlan(os.Stdout, plan)
+	}
+	if cfg.RegistryCheck != "" {
+		return registryCheck(ctx, os.Stdout, f, plan, cfg)
+	}
+
+	// Each directory is handled in its own goroutine, at most cfg.Concurrency
+	// at a time. Unless running with -continue-on-error, the first failure
+	// stops any more from being started.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make([]dirResult, len(plan))
+	sem := make(chan struct{}, max(cfg.Concurrency, 1))
+	var wg sync.WaitGroup
+	for i, e := range plan {
+		sem <- struct{}{}
+		if err := ctx.Err(); err != nil {
+			results[i].err = err
+			break
+		}
+		wg.Add(1)
+		go func(i int, e planEntry) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = processDir(ctx, f, e, cfg)
+			if results[i].err != nil && !cfg.ContinueOnError {
+				cancel()
+			}
+		}(i, e)
+	}
+	wg.Wait()
+
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ctx.Err()
+	}
+
+	// The results are in plan order, so failures are reported sorted by
+	// directory however the goroutines happened to finish.
+	summary.count(plan, results)
+	var drift int
+	var failed []error
+	for i, res := range results {
+		if res.err != nil {
+			failed = append(failed, res.err)
+			continue
+		}
+		if res.drifted {
+			fmt.Println(filepath.ToSlash(plan[i].Dir))
+			drift++
+		}
+	}
+	// The records of what changed are written even when some directories
+	// failed, since those that succeeded have changed all the same.
+	if cfg.Output == "json" && !cfg.Check {
+		if err := writeResults(os.Stdout, changedResults(plan, results)); err != nil {
+			return err
+		}
+	}
+	if len(failed) > 0 && !cfg.ContinueOnError {
+		return firstFailure(failed)
+	}
+	for _, err := range failed {
+		infof("%s", err)
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%d version directories failed", len(failed))
+	}
+	if drift > 0 && !cfg.ListChanged {
+		return fmt.Errorf("%d version directories are out of date", drift)
+	}
+
+	if cfg.Make && !cfg.Check {
+		if err := writeMakefile(builds(plan, cfg), cfg); err != nil {
+			return fmt.Errorf("error writing Makefile: %w", err)
+		}
+	}
+	if cfg.MultiStage != "" && !cfg.Check {
+		if err := writeMultiStage(stages(plan, results, cfg), cfg); err != nil {
+			return fmt.Errorf("error writing %s: %w", cfg.MultiStage, err)
 		}
+	}
+	if cfg.NewerThanFile != "" && !cfg.Check {
+		if err := writeStamp(cfg.NewerThanFile, f.feedsKey, cfg); err != nil {
+			return fmt.Errorf("error writing %s: %w", cfg.NewerThanFile, err)
+		}
+	}
+	return nil
+}
 
-		if err := update(dir, p); err != nil {
-			fmt.Printf("error updating %s: %s\n", dir, err)
-			os.Exit(1)
+// checkEntrypointSource makes sure the entrypoint that gets copied into every
+// version directory is there to be copied.
+func checkEntrypointSource(name string) error {
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("entrypoint source %s not found; run from the repository root, set -entrypoint-src or use -no-entrypoint", name)
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("entrypoint source %s is not a regular file", name)
+	}
+	return nil
+}
+
+// firstFailure picks the error to report when the run stopped at the first
+// failure. Directories still in progress at that point fail with
+// context.Canceled, so the error that caused the cancellation is preferred
+// over those even if it comes later in the plan.
+func firstFailure(failed []error) error {
+	for _, err := range failed {
+		if !errors.Is(err, context.Canceled) {
+			return err
 		}
 	}
+	return failed[0]
+}
+
+// dirResult is the outcome of processing a single version directory.
+type dirResult struct {
+	drifted bool
+	pruned  bool
+	updated updateResult
+	// pkg is the package the directory was updated to, with its SHA256
+	// filled in by -checksum.
+	pkg Package
+	err error
 }
 
-func update(dir string, pkg Package) (err error) {
-	f, err := os.OpenFile(filepath.Join(dir, "Dockerfile"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+// processDir carries out the plan for a single version directory. With
+// -check nothing is changed; creates, prunes and updates that would change
+// files are reported as drift instead.
+func processDir(ctx context.Context, f *fetcher, e planEntry, cfg Config) dirResult {
+	cfg = e.config(cfg)
+	dir := e.Dir
+	switch e.Action {
+	case actionSkip:
+		if !cfg.ListChanged {
+			infof("skipping %s: %s", dir, e.Reason)
+		}
+		return dirResult{}
+	case actionMissing:
+		return dirResult{err: fmt.Errorf("%s for version %s", e.Reason, dir)}
+	case actionPrune:
+		if cfg.Check {
+			return dirResult{drifted: true}
+		}
+		if cfg.OutDir != "" {
+			infof("not pruning %s with -out-dir", dir)
+			return dirResult{}
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return dirResult{err: fmt.Errorf("error pruning %s: %w", dir, err)}
+		}
+		infof("pruned %s", dir)
+		return dirResult{pruned: true}
+	case actionCreate:
+		if cfg.Check {
+			return dirResult{drifted: true}
+		}
+		// With -out-dir the directory is only made in the mirror, by
+		// updateTarget.
+		if cfg.OutDir == "" {
+			if err := os.Mkdir(dir, 0755); err != nil {
+				return dirResult{err: fmt.Errorf("error creating %s: %w", dir, err)}
+			}
+		}
+		infof("created %s for %s", dir, e.Package)
+	}
+
+	if cfg.PruneBackups && !cfg.Check && cfg.OutDir == "" {
+		if err := pruneBackup(dir); err != nil {
+			return dirResult{err: fmt.Errorf("error pruning backup in %s: %w", dir, err)}
+		}
+	}
+
+	p := e.Package
+	debugf("%s resolved to %s: %s from %s", dir, p, p.ZipURL, p.Source)
+
+	if cfg.Checksum {
+		sum, err := f.checksum(ctx, p.ZipURL)
+		if err != nil {
+			return dirResult{err: fmt.Errorf("error checksumming %s: %w", p.ZipURL, err)}
+		}
+		p.SHA256 = sum
+	}
+
+	e.Package = p
+	if cfg.Check {
+		d, err := drifted(e, cfg)
+		if err != nil {
+			return dirResult{err: fmt.Errorf("error checking %s: %w", dir, err)}
+		}
+		return dirResult{drifted: d}
+	}
+
+	res, err := update(e, cfg)
+	if errors.Is(err, os.ErrPermission) && !errors.Is(err, errChown) {
+		// Rather than the failing temporary file's name, say what to fix.
+		// A chown refused with EPERM is about -uid and -gid instead.
+		return dirResult{updated: res, err: fmt.Errorf("directory %s is not writable: %w", dir, err)}
+	}
+	if err != nil {
+		return dirResult{updated: res, err: fmt.Errorf("error updating %s: %w", dir, err)}
+	}
+	if cfg.PostHook != "" {
+		if err := runPostHook(ctx, filepath.Join(cfg.OutDir, dir), p, cfg); err != nil {
+			return dirResult{updated: res, err: err}
+		}
+	}
+	return dirResult{updated: res, pkg: p}
+}
+
+// updateResult describes what update did for a version directory.
+type updateResult struct {
+	Version Version
+	// PreviousVersion and PreviousURL are read from the Dockerfile that was
+	// there before, and are empty if there wasn't one or they couldn't be.
+	PreviousVersion Version
+	PreviousURL     string
+	// Files are the paths of every file written, in the order they were.
+	Files []string
+	// Changed is whether any of them differed from what was there before.
+	Changed bool
+}
+
+func update(e planEntry, cfg Config) (res updateResult, err error) {
+	res.Version = e.Package.Version
+	ts := targets(e, cfg)
+	if len(ts) > 0 {
+		res.PreviousVersion, res.PreviousURL = previousPackage(ts[0].dir)
+	}
+	for _, t := range ts {
+		// Anything that stops the comparison, such as a missing file, is
+		// taken as a change; updateTarget reports any real problem.
+		d, err := targetDrifted(t, cfg)
+		res.Changed = res.Changed || d || err != nil
+		files, err := updateTarget(t, cfg)
+		res.Files = append(res.Files, files...)
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, nil
+}
+
+func updateTarget(t target, cfg Config) (files []string, err error) {
+	if err := os.MkdirAll(t.out, 0755); err != nil {
+		return nil, err
+	}
+	dockerfile, err := dockerfileFor(t)
+	if err != nil {
+		return nil, err
+	}
+	name := filepath.Join(t.out, "Dockerfile")
+	if err := writeFileAtomic(name, dockerfile, 0644, cfg.Fsync); err != nil {
+		return files, err
+	}
+	files = append(files, name)
+	if err := chownGenerated(name, cfg); err != nil {
+		return files, err
+	}
+	if cfg.Metadata {
+		metadata, err := renderMetadata(t, cfg)
+		if err != nil {
+			return files, err
+		}
+		name := filepath.Join(t.out, "metadata.json")
+		if err := writeFileAtomic(name, metadata, 0644, cfg.Fsync); err != nil {
+			return files, err
+		}
+		files = append(files, name)
+		if err := chownGenerated(name, cfg); err != nil {
+			return files, err
+		}
+	}
+	if cfg.BuildArgs {
+		name := filepath.Join(t.out, "args.env")
+		if err := writeFileAtomic(name, renderBuildArgs(t), 0644, cfg.Fsync); err != nil {
+			return files, err
+		}
+		files = append(files, name)
+		if err := chownGenerated(name, cfg); err != nil {
+			return files, err
+		}
+	}
+	if cfg.NoEntrypoint {
+		return files, nil
+	}
+	if err := copyEntrypoint(t.out, cfg); err != nil {
+		return files, err
+	}
+	return append(files, filepath.Join(t.out, cfg.EntrypointDst)), nil
+}
+
+// copyEntrypoint copies docker-entrypoint.sh into dir, as executable inside the
+// container or with the source's own permissions with
+// -preserve-entrypoint-mode.
+func copyEntrypoint(dir string, cfg Config) error {
+	dst := filepath.Join(dir, cfg.EntrypointDst)
+	perm := os.FileMode(0764)
+	if cfg.PreserveEntrypointMode {
+		info, err := os.Stat(cfg.EntrypointSrc)
+		if err != nil {
+			return err
+		}
+		perm = info.Mode().Perm()
+	}
+	data, err := ioutil.ReadFile(cfg.EntrypointSrc)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	if err := tmpl.Execute(f, pkg); err != nil {
+	if err := writeFileAtomic(dst, data, perm, cfg.Fsync); err != nil {
 		return err
 	}
-	err = copyFile("docker-entrypoint.sh", filepath.Join(dir, "docker-entrypoint.sh"), 0764)
+	return chownGenerated(dst, cfg)
+}
+
+// syncEntrypoints copies docker-entrypoint.sh into every version directory, or
+// every variant subdirectory that exists, without touching anything else. It
+// doesn't need the feeds.
+func syncEntrypoints(versionDirs []string, cfg Config) error {
+	for _, dir := range versionDirs {
+		if !isVersionDir(dir, cfg) || contains(cfg.Hold, dir) {
+			continue
+		}
+		dsts := []string{dir}
+		if len(cfg.Variants) > 0 {
+			dsts = nil
+			for _, v := range cfg.Variants {
+				if info, err := os.Stat(filepath.Join(dir, v.Name)); err == nil && info.IsDir() {
+					dsts = append(dsts, filepath.Join(dir, v.Name))
+				}
+			}
+		}
+		for _, dst := range dsts {
+			if err := copyEntrypoint(dst, cfg); err != nil {
+				return fmt.Errorf("error syncing entrypoint into %s: %w", dst, err)
+			}
+			infof("synced %s", filepath.ToSlash(dst))
+		}
+	}
+	return nil
+}
+
+// dockerfileFor renders the Dockerfile for t, unless the one already in its
+// directory differs only in the build date, which is then kept as it is. That
+// way a -source-date that moves with every commit, as SOURCE_DATE_EPOCH often
+// does, doesn't regenerate every directory on every run.
+func dockerfileFor(t target) ([]byte, error) {
+	tm, err := templateFor(t)
+	if err != nil {
+		return nil, err
+	}
+	dockerfile, err := renderDockerfile(tm, t.data)
+	if err != nil {
+		return nil, err
+	}
+	have, err := ioutil.ReadFile(filepath.Join(t.dir, "Dockerfile"))
+	if err != nil || bytes.Equal(have, dockerfile) {
+		return dockerfile, nil
+	}
+	if onlyBuildDateDiffers(have, tm, t.data) {
+		debugf("%s only differs in its build date; keeping it", path.Join(filepath.ToSlash(t.dir), "Dockerfile"))
+		return have, nil
+	}
+	return dockerfile, nil
+}
+
+// buildDatePlaceholder stands in for the build date when working out where
+// in a rendered Dockerfile it goes.
+const buildDatePlaceholder = "\x00build-date\x00"
+
+// onlyBuildDateDiffers reports whether have is what tm renders for data with
+// some other build date, the same one everywhere the date appears.
+func onlyBuildDateDiffers(have []byte, tm *template.Template, data templateData) bool {
+	data.BuildDate = buildDatePlaceholder
+	var buf bytes.Buffer
+	if err := tm.Execute(&buf, data); err != nil {
+		return false
+	}
+	parts := strings.Split(buf.String(), buildDatePlaceholder)
+	if len(parts) < 2 {
+		return false
+	}
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	m := regexp.MustCompile(`\A` + strings.Join(parts, `([^\n]*?)`) + `\z`).FindStringSubmatch(string(have))
+	if m == nil {
+		return false
+	}
+	for _, date := range m[2:] {
+		if date != m[1] {
+			return false
+		}
+	}
+	return true
+}
+
+// renderDockerfile executes tm for data and checks the result.
+func renderDockerfile(tm *template.Template, data templateData) ([]byte, error) {
+	if data.Version == "" {
+		return nil, errors.New("package has an empty Version")
+	}
+	if data.ZipURL == "" {
+		return nil, errors.New("package has an empty ZipURL")
+	}
+	var buf bytes.Buffer
+	if err := tm.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	if err := checkRendered(buf.Bytes(), data.Package); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drifted reports whether any of the files update would write for e differ
+// from what is already there. Nothing is written.
+func drifted(e planEntry, cfg Config) (bool, error) {
+	for _, t := range targets(e, cfg) {
+		d, err := targetDrifted(t, cfg)
+		if d || err != nil {
+			return d, err
+		}
+	}
+	return false, nil
+}
+
+func targetDrifted(t target, cfg Config) (bool, error) {
+	want := map[string][]byte{}
+	dockerfile, err := dockerfileFor(t)
+	if err != nil {
+		return false, err
+	}
+	want["Dockerfile"] = dockerfile
+	if cfg.Metadata {
+		if want["metadata.json"], err = renderMetadata(t, cfg); err != nil {
+			return false, err
+		}
+	}
+	if cfg.BuildArgs {
+		want["args.env"] = renderBuildArgs(t)
+	}
+	if !cfg.NoEntrypoint {
+		if want[cfg.EntrypointDst], err = ioutil.ReadFile(cfg.EntrypointSrc); err != nil {
+			return false, err
+		}
+	}
+
+	for name, data := range want {
+		have, err := ioutil.ReadFile(filepath.Join(t.dir, name))
+		if os.IsNotExist(err) || (err == nil && !bytes.Equal(have, data)) {
+			debugf("%s differs", path.Join(filepath.ToSlash(t.dir), name))
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	if cfg.NoEntrypoint {
+		return false, nil
+	}
+	perm := os.FileMode(0764)
+	if cfg.PreserveEntrypointMode {
+		info, err := os.Stat(cfg.EntrypointSrc)
+		if err != nil {
+			return false, err
+		}
+		perm = info.Mode().Perm()
+	}
+	info, err := os.Stat(filepath.Join(t.dir, cfg.EntrypointDst))
 	if err != nil {
+		return false, err
+	}
+	return info.Mode().Perm() != perm, nil
+}
+
+// pruneBackup removes the Dockerfile.bak in dir if there is one. Nothing else
+// in the directory is touched.
+func pruneBackup(dir string) error {
+	name := filepath.Join(dir, "Dockerfile.bak")
+	if err := os.Remove(name); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
 		return err
 	}
-	// If the file already existed the permissions might not be correct to run
-	// inside the container.
-	return os.Chmod(filepath.Join(dir, "docker-entrypoint.sh"), 0764)
+	infof("removed %s", filepath.ToSlash(name))
+	return nil
+}
+
+// Metadata is written to metadata.json in each version directory when running
+// with -metadata. It records what the Dockerfile was generated from.
+type Metadata struct {
+	Version  Version  `json:"version"`
+	ZipURL   string   `json:"zipUrl"`
+	Released string   `json:"released"`
+	Latest   bool     `json:"latest"`
+	Tags     []string `json:"tags"`
+	Channel  string   `json:"channel"`
+	Source   string   `json:"source"`
+	SHA256   string   `json:"sha256,omitempty"`
 }
 
-func getDirs(path string) (dirs []string, err error) {
-	entries, err := ioutil.ReadDir(".")
+// renderBuildArgs returns the args.env written with -build-args, one
+// KEY=VALUE line for each value a Dockerfile could take as an ARG. CROWD_SHA256
+// is empty without -checksum.
+func renderBuildArgs(t target) []byte {
+	pkg := t.data.Package
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "CROWD_VERSION=%s\n", pkg.Version)
+	fmt.Fprintf(&buf, "CROWD_ZIP_URL=%s\n", pkg.ZipURL)
+	fmt.Fprintf(&buf, "CROWD_SHA256=%s\n", pkg.SHA256)
+	fmt.Fprintf(&buf, "CROWD_RELEASED=%s\n", time.Time(pkg.Released).Format("2006-01-02"))
+	return buf.Bytes()
+}
+
+func renderMetadata(t target, cfg Config) ([]byte, error) {
+	pkg := t.data.Package
+	data, err := json.MarshalIndent(Metadata{
+		Version:  pkg.Version,
+		ZipURL:   pkg.ZipURL,
+		Released: time.Time(pkg.Released).Format("2006-01-02"),
+		Latest:   pkg.Latest,
+		Tags:     tags(t, cfg),
+		Channel:  pkg.Channel,
+		Source:   pkg.Source,
+		SHA256:   pkg.SHA256,
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// checkRendered makes sure the template actually substituted the package's
+// Version and ZipURL into the Dockerfile. When the URL is missing, the error
+// says whether its host is there at all, which points at a template that
+// hardcodes a tarball rather than one that dropped the field.
+func checkRendered(data []byte, pkg Package) error {
+	if !bytes.Contains(data, []byte(pkg.Version)) {
+		return fmt.Errorf("rendered Dockerfile does not contain Version %q", pkg.Version)
+	}
+	if bytes.Contains(data, []byte(pkg.ZipURL)) {
+		return nil
+	}
+	if u, err := url.Parse(pkg.ZipURL); err == nil && u.Host != "" && bytes.Contains(data, []byte(u.Host)) {
+		return fmt.Errorf("rendered Dockerfile refers to %s but not to ZipURL %q; does the template hardcode a URL?", u.Host, pkg.ZipURL)
+	}
+	return fmt.Errorf("rendered Dockerfile does not contain ZipURL %q", pkg.ZipURL)
+}
+
+// getDirs lists the version directories in root. Entries that can't be
+// stat'd are logged and skipped; only failing to read root itself is an error.
+// Symlinks are skipped too, even ones pointing at a directory, so nothing is
+// ever written through a link to somewhere outside the repository.
+func getDirs(root string) (dirs []string, err error) {
+	entries, err := os.ReadDir(root)
 	if err != nil {
 		return nil, err
 	}
 	for _, entry := range entries {
-		if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+		if strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			warnf("unreadable_entry", "skipping %s: %s", filepath.Join(root, entry.Name()), err)
+			continue
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			debugf("skipping %s: symlink", filepath.Join(root, entry.Name()))
+			continue
+		}
+		if info.IsDir() {
 			dirs = append(dirs, entry.Name())
 		}
 	}
 	return dirs, nil
 }
 
-// getVersions gets the latest packages from the feeds and marks any from the
-// latestFeed as Latest.
-func getVersions(latestFeed string, otherFeeds ...string) (versions map[string]Package, err error) {
-	versions = map[string]Package{}
+// getVersions resolves the newest package for each major.minor, or each full
+// version with -group-by-patch, across all of the feeds and marks any from the
+// current channel as Latest. Each package records the feed it came from in
+// Channel and Source. Feeds later in the list take priority when two entries
+// are otherwise identical. The rules of the config file's directories are
+// resolved the same way into ruled.
+func (f *fetcher) getVersions(ctx context.Context, feeds []feed) (versions map[string]Package, ruled map[versionRule]Package, err error) {
+	fetched, err := f.readFeeds(ctx, feeds)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Resolving is skipped when the same feed bodies were resolved the same
+	// way before.
+	key := f.resolutionKey(fetched)
+	f.feedsKey = key
+	if versions, ruled, ok := f.loadResolved(key); ok {
+		debugf("feeds unchanged since they were last resolved")
+		f.rewritePackages(versions, ruled)
+		return versions, ruled, nil
+	}
+	// The entries left out are only listed with -verbose, since the archive
+	// feed has thousands of them. A version key whose current release is
+	// too recent for the -stability-window is still latest, with the release
+	// it falls back to.
+	held := map[string]bool{}
+	err = parseFeeds(fetched, func(p Package) bool {
+		reason := f.skipReason(p)
+		if reason != "" && verbose {
+			debugf("skipping %s %q for %s: %s", p.Version, p.ZipURL, f.groupKey(p), reason)
+		}
+		if reason == reasonTooRecent && p.Latest {
+			held[f.groupKey(p)] = true
+		}
+		return reason == ""
+	})
+	if err != nil {
+		return nil, nil, err
+	}
 
-	for _, url := range append(otherFeeds, latestFeed) {
-		newVersions, err := fetchLatestTarVersions(url)
-		if err != nil {
-			return nil, err
+	versions, ruled = f.resolve(fetched), f.resolveRules(fetched)
+	for key := range held {
+		if p, ok := versions[key]; ok {
+			p.Latest = true
+			versions[key] = p
 		}
-		for v, p := range newVersions {
-			if url == latestFeed {
-				p.Latest = true
+	}
+	if err := f.saveResolved(key, versions, ruled); err != nil {
+		return nil, nil, err
+	}
+	f.rewritePackages(versions, ruled)
+	return versions, ruled, nil
+}
+
+// rewritePackages applies the -url-rewrite rules to the tarball URL of every
+// resolved package, so the Dockerfiles download them through the mirror too.
+// The resolved packages are saved before this, so changing the rules doesn't
+// need the feeds resolving again.
+func (f *fetcher) rewritePackages(versions map[string]Package, ruled map[versionRule]Package) {
+	if len(f.urlRewrite) == 0 {
+		return
+	}
+	for k, p := range versions {
+		p.ZipURL = f.rewrite(p.ZipURL)
+		versions[k] = p
+	}
+	for r, p := range ruled {
+		p.ZipURL = f.rewrite(p.ZipURL)
+		ruled[r] = p
+	}
+}
+
+// resolve picks the package for each version key from the parsed entries of
+// fetched, following f.replaces.
+func (f *fetcher) resolve(fetched []feedEntries) map[string]Package {
+	versions := map[string]Package{}
+	warned := map[Version]bool{}
+	for _, fe := range fetched {
+		for _, p := range fe.pkgs {
+			key := f.groupKey(p)
+			v, ok := versions[key]
+			if ok && v.Version.Compare(p.Version) == 0 && v.Artifact == p.Artifact && path.Base(v.ZipURL) != path.Base(p.ZipURL) && !warned[p.Version] {
+				warned[p.Version] = true
+				warnf("duplicate_version", "%s has two tarballs, %s and %s; preferring the shorter, or alphabetically first, filename", p.Version, v.ZipURL, p.ZipURL)
+			}
+			if !ok || f.replaces(p, v) {
+				versions[key] = p
 			}
-			versions[v] = p
 		}
 	}
-	return versions, nil
+	return versions
 }
 
-// fetchLatestTarVersions reads the atlassian download feed and fetches the
-// latest tar.gz entry for each version.
-func fetchLatestTarVersions(url string) (versions map[string]Package, err error) {
-	resp, err := http.Get(url)
+// feedEntries holds the body read from one URL of a feed and, once parsed,
+// every entry in it, each marked with the feed it came from.
+type feedEntries struct {
+	feed feed
+	url  string
+	body []byte
+	pkgs []Package
+}
+
+// fetchFeeds reads every URL of every feed, in order, and returns all of
+// their entries unfiltered.
+func (f *fetcher) fetchFeeds(ctx context.Context, feeds []feed) ([]feedEntries, error) {
+	fetched, err := f.readFeeds(ctx, feeds)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	return fetched, parseFeeds(fetched, nil)
+}
+
+// readFeeds reads the body of every URL of every feed, in order, without
+// parsing them. The URLs that fail are left out unless every one does, when
+// all of their errors are returned together.
+func (f *fetcher) readFeeds(ctx context.Context, feeds []feed) ([]feedEntries, error) {
+	var fetched []feedEntries
+	for _, fd := range feeds {
+		for _, url := range fd.URLs {
+			fetched = append(fetched, feedEntries{feed: fd, url: url})
+		}
+	}
+	errs := make([]error, len(fetched))
+	if f.parallel {
+		var wg sync.WaitGroup
+		for i := range fetched {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				fetched[i].body, errs[i] = f.readFeed(ctx, fetched[i].url)
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i := range fetched {
+			fetched[i].body, errs[i] = f.readFeed(ctx, fetched[i].url)
+		}
+	}
+
+	// A feed that can't be read, such as one Atlassian has retired, is
+	// left out with a warning as long as another can be, unless -strict.
+	var read []feedEntries
+	var failed []error
+	for i, err := range errs {
+		if err == nil {
+			read = append(read, fetched[i])
+		} else {
+			failed = append(failed, err)
+		}
+	}
+	if len(failed) > 0 && (f.strict || ctx.Err() != nil) {
+		return nil, failed[0]
+	}
+	if len(failed) > 0 && len(read) == 0 {
+		return nil, errors.Join(failed...)
+	}
+	f.unavailable += len(failed)
+	for i, err := range errs {
+		if err != nil {
+			warnf("feed_unavailable", "leaving out the %s feed: %v", fetched[i].feed.Channel, err)
+		}
 	}
+	return read, nil
+}
+
+// parseFeeds parses the body of each of the fetched feeds into its entries,
+// keeping only those keep accepts, or all of them if keep is nil.
+func parseFeeds(fetched []feedEntries, keep func(Package) bool) error {
+	for i := range fetched {
+		fe := &fetched[i]
+		pkgs, err := parsePackages(fe.body, fe.feed, fe.url, keep)
+		if err != nil {
+			return err
+		}
+		fe.pkgs = pkgs
+	}
+	return nil
+}
+
+// parsePackages returns the entries in the body of the atlassian download
+// feed fd read from url that keep accepts, each marked with the feed it came
+// from. The entries are decoded one at a time and filtered as they are, since
+// the archive feed has thousands that are mostly unwanted.
+func parsePackages(data []byte, fd feed, url string, keep func(Package) bool) (pkgs []Package, err error) {
 	start := bytes.Index(data, []byte("("))
 	end := bytes.LastIndex(data, []byte(")"))
 	if !(end > start && start > -1) {
 		return nil, errors.New("error in jsonp content")
 	}
-	var archives []Package
-	err = json.Unmarshal(data[start+1:end], &archives)
-	if err != nil {
+	dec := json.NewDecoder(bytes.NewReader(data[start+1 : end]))
+	if tok, err := dec.Token(); err != nil {
 		return nil, err
+	} else if tok != json.Delim('[') {
+		return nil, fmt.Errorf("feed %s is not a list of packages", url)
 	}
-	versions = map[string]Package{}
-	for _, archive := range archives {
-		filename := path.Base(archive.ZipURL)
-		if !strings.Contains(filename, ".tar.gz") ||
-			(strings.Contains(filename, "enterprise") && !strings.Contains(filename, "standalone")) ||
-			strings.Contains(filename, "cluster") ||
-			strings.Contains(filename, "war") {
-			continue
+	for dec.More() {
+		var p Package
+		if err := dec.Decode(&p); err != nil {
+			return nil, err
+		}
+		p.Artifact = artifactType(path.Base(p.ZipURL))
+		p.Edition = editionOf(path.Base(p.ZipURL))
+		p.Latest = fd.Channel == channelCurrent
+		p.Channel = fd.Channel
+		p.Source = url
+		if !usableVersion.MatchString(string(p.Version)) {
+			if m := filenameVersion.FindStringSubmatch(path.Base(p.ZipURL)); m != nil {
+				warnf("version_from_filename", "%s has version %q in %s; using %s from its filename", p.ZipURL, p.Version, url, m[1])
+				p.Version = Version(m[1])
+			}
 		}
-		majmin := archive.Version.MajorMinor()
-		v, ok := versions[majmin]
-		if !ok || time.Time(archive.Released).After(time.Time(v.Released)) {
-			versions[majmin] = archive
+		if keep == nil || keep(p) {
+			pkgs = append(pkgs, p)
 		}
 	}
-	return versions, nil
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return pkgs, nil
+}
+
+// The kinds of artifact kept from the feeds.
+const (
+	artifactStandalone = "standalone"
+	artifactWar        = "war"
+
+	// editionDataCenter is the Edition of a Data Center build.
+	editionDataCenter = "dc"
+)
+
+// unwantedReason explains why the download filename isn't a standalone
+// tarball the images can be built from, or returns "" if it is. Cluster
+// builds are never wanted, and war builds only with -include-war. Enterprise
+// builds are only wanted as the standalone distribution, so
+// "enterprise-standalone" is kept while any other enterprise build is not.
+func unwantedReason(filename string, includeWar bool) string {
+	switch {
+	case strings.Contains(filename, "cluster"):
+		return "cluster build"
+	case strings.Contains(filename, "war"):
+		if includeWar {
+			return ""
+		}
+		return "war build"
+	case !strings.Contains(filename, ".tar.gz"):
+		return "not a tar.gz"
+	case strings.Contains(filename, "enterprise") && !strings.Contains(filename, "standalone"):
+		return "enterprise build that isn't standalone"
+	}
+	return ""
+}
+
+// skipReason explains why getVersions leaves out the feed entry p, or returns
+// "" if it is kept. The entry's own type and platform are trusted when the
+// feed gives them, and its filename is checked either way.
+func (f *fetcher) skipReason(p Package) string {
+	switch {
+	case p.ZipURL == "":
+		return "no download URL"
+	case p.Type != "" && !strings.EqualFold(p.Type, "binary"):
+		return fmt.Sprintf("%s download, not a binary", p.Type)
+	case p.Platform != "" && !unixPlatform(p.Platform):
+		return fmt.Sprintf("%s build, not for unix", p.Platform)
+	case p.Channel != channelEAP && !f.stableCutoff.IsZero() && time.Time(p.Released).After(f.stableCutoff):
+		return reasonTooRecent
+	}
+	return unwantedReason(path.Base(p.ZipURL), f.includeWar)
+}
+
+// reasonTooRecent is the skipReason for a stable release made within the
+// -stability-window.
+const reasonTooRecent = "released within the -stability-window"
+
+// unixPlatform reports whether a feed entry's platform, such as "Unix" or
+// "Windows", covers the linux images are built for. Entries for every
+// platform, such as the war builds', don't name windows or mac.
+func unixPlatform(platform string) bool {
+	platform = strings.ToLower(platform)
+	if strings.Contains(platform, "unix") || strings.Contains(platform, "linux") {
+		return true
+	}
+	return !strings.Contains(platform, "windows") && !strings.Contains(platform, "mac")
+}
+
+// editionOf returns editionDataCenter for a Data Center build's filename and
+// "" for the standard edition.
+func editionOf(filename string) string {
+	for _, s := range []string{"datacenter", "data-center", "-dc-", "-dc."} {
+		if strings.Contains(filename, s) {
+			return editionDataCenter
+		}
+	}
+	return ""
+}
+
+// artifactType returns artifactWar for a war build's filename and
+// artifactStandalone for anything else.
+func artifactType(filename string) string {
+	if strings.Contains(filename, "war") {
+		return artifactWar
+	}
+	return artifactStandalone
 }
 
 type Package struct {
+	// ZipURL has any -url-rewrite applied once resolved, so it points at
+	// the mirror.
 	ZipURL   string        `json:"zipUrl"`
 	Version  Version       `json:"version"`
 	Released AtlassianTime `json:"released"`
 	Latest   bool
+	Channel  string `json:"-"`
+	Source   string
+	// MajorLatest is set with -select-latest-per-major on the highest version
+	// of each major, which is then also tagged with just the major.
+	MajorLatest bool `json:"-"`
+	// EAPLatest is set with -eap-tag on the highest version from the EAP
+	// feed, which is then also tagged with the -eap-tag.
+	EAPLatest bool `json:"-"`
+	// SHA256 is only filled in with -checksum, which downloads the tarball.
+	SHA256 string `json:"-"`
+	// Artifact is artifactStandalone, or artifactWar for the war builds kept
+	// with -include-war, so a template can build those differently.
+	Artifact string `json:"-"`
+	// Edition is editionDataCenter for a Data Center build and empty for
+	// the standard one.
+	Edition string `json:"-"`
+	// Type and Platform are the feed's own description of the download,
+	// such as Binary and Unix, when it gives one.
+	Type     string `json:"type"`
+	Platform string `json:"platform"`
+}
+
+// String describes the package for logs, for example
+// "crowd 2.11.1 (released 14 Mar 2017) [current, latest]".
+func (p Package) String() string {
+	s := fmt.Sprintf("crowd %s (released %s)", p.Version, time.Time(p.Released).Format("2 Jan 2006"))
+	var labels []string
+	if p.Channel != "" {
+		labels = append(labels, p.Channel)
+	}
+	if p.Latest {
+		labels = append(labels, "latest")
+	}
+	if len(labels) > 0 {
+		s += " [" + strings.Join(labels, ", ") + "]"
+	}
+	return s
+}
+
+// checkReleaseDates warns about any resolved package released after now,
+// which is almost certainly a mis-dated feed entry that won the release date
+// tiebreak. With -strict it is an error instead.
+func checkReleaseDates(versions map[string]Package, now time.Time, cfg Config) error {
+	var keys []string
+	for k, p := range versions {
+		if time.Time(p.Released).After(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		p := versions[k]
+		if cfg.Strict {
+			return fmt.Errorf("%s resolved to %s, which has a release date in the future", k, p)
+		}
+		warnf("future_release", "%s resolved to %s, which has a release date in the future", k, p)
+	}
+	return nil
+}
+
+// checkMaxAge warns when the newest of the resolved packages was released
+// more than -max-age before now, since Atlassian going that long without a
+// release more likely means the feeds being read have stopped updating. With
+// -strict it is an error instead.
+func checkMaxAge(versions map[string]Package, now time.Time, cfg Config) error {
+	if cfg.MaxAge <= 0 || len(versions) == 0 {
+		return nil
+	}
+	var newest Package
+	for _, p := range versions {
+		if time.Time(p.Released).After(time.Time(newest.Released)) {
+			newest = p
+		}
+	}
+	if !time.Time(newest.Released).Before(now.Add(-time.Duration(cfg.MaxAge))) {
+		return nil
+	}
+	if cfg.Strict {
+		return fmt.Errorf("the newest resolved version, %s, is older than the -max-age of %s", newest, cfg.MaxAge)
+	}
+	warnf("stale_feeds", "the newest resolved version, %s, is older than the -max-age of %s", newest, cfg.MaxAge)
+	return nil
+}
+
+// markLatestPerMajor sets MajorLatest on the highest stable version of each
+// major, or with editions of each major and edition, among the directories in
+// the plan being created or updated. EAP releases and versions without a
+// directory never get the major's tag.
+func markLatestPerMajor(plan []planEntry, editions bool) {
+	best := map[string]int{}
+	for i, e := range plan {
+		p := e.Package
+		if e.Action != actionCreate && e.Action != actionUpdate || p.Channel == channelEAP {
+			continue
+		}
+		major := p.Version.Major()
+		if editions {
+			major += "-" + p.Edition
+		}
+		if b, ok := best[major]; !ok || p.Version.Compare(plan[b].Package.Version) > 0 {
+			best[major] = i
+		}
+	}
+	for _, i := range best {
+		plan[i].Package.MajorLatest = true
+	}
+}
+
+// markLatestEAP sets EAPLatest on the highest version from the EAP channel,
+// if any came from it.
+func markLatestEAP(versions map[string]Package) {
+	var best string
+	for key, p := range versions {
+		if p.Channel != channelEAP {
+			continue
+		}
+		if best == "" || p.Version.Compare(versions[best].Version) > 0 {
+			best = key
+		}
+	}
+	if best != "" {
+		p := versions[best]
+		p.EAPLatest = true
+		versions[best] = p
+	}
+}
+
+// replaces reports whether getVersions prefers p over q, the package it has
+// so far for the same major.minor. A stable release always wins over an EAP
+// one, so an EAP release is only used when there is no stable one. With
+// -include-war a war build wins over any other build of the same version,
+// otherwise q must not be newerThan p.
+func (f *fetcher) replaces(p, q Package) bool {
+	if (p.Channel == channelEAP) != (q.Channel == channelEAP) {
+		return q.Channel == channelEAP
+	}
+	if f.includeWar && p.Version.Compare(q.Version) == 0 && p.Artifact != q.Artifact {
+		return p.Artifact == artifactWar
+	}
+	return !q.newerThan(p)
+}
+
+// newerThan reports whether p should be preferred over q: it has a higher
+// version, or the same version with a later release date. Two different
+// tarballs of the same version are ambiguous, so rather than going by date
+// the one with the shorter filename wins, or the first alphabetically.
+func (p Package) newerThan(q Package) bool {
+	if c := p.Version.Compare(q.Version); c != 0 {
+		return c > 0
+	}
+	if a, b := path.Base(p.ZipURL), path.Base(q.ZipURL); a != b {
+		if len(a) != len(b) {
+			return len(a) < len(b)
+		}
+		return a < b
+	}
+	return time.Time(p.Released).After(time.Time(q.Released))
 }
 
 type Version string
 
-var versionSeparator = regexp.MustCompile(`(\.|-)`)
+func (v Version) Major() string {
+	return versionSeparator.Split(string(v), 2)[0]
+}
+
+// groupKey returns the key of the version directory p belongs in: its
+// major.minor, or as many components as -group-depth says, or with
+// -group-by-patch the whole version. With
+// -separate-editions a Data Center build's key ends in "-dc".
+func (f *fetcher) groupKey(p Package) string {
+	key := p.Version.leading(f.groupDepth)
+	if f.groupByPatch {
+		key = string(p.Version.normalized())
+	}
+	if f.separateEditions && p.Edition != "" {
+		key += "-" + p.Edition
+	}
+	return key
+}
+
+// normalized returns v with every "-" between two numeric components replaced
+// by ".", so that upstream's occasional "5-1-0" groups with "5.1.0". Others,
+// such as the one before an EAP suffix in "5.2.0-m01", are kept.
+func (v Version) normalized() Version {
+	b := []byte(v)
+	for i := 1; i < len(b)-1; i++ {
+		if b[i] == '-' && isDigit(b[i-1]) && isDigit(b[i+1]) {
+			b[i] = '.'
+		}
+	}
+	return Version(b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// leading returns the first n numeric components of v, normalized, with any
+// that are missing taken as 0, so 5.1 gives 5.1.0 for n of 3.
+func (v Version) leading(n int) string {
+	parts := versionSeparator.Split(string(v.normalized()), -1)
+	key := make([]string, n)
+	for i := range key {
+		key[i] = "0"
+		if i < len(parts) {
+			if _, err := strconv.Atoi(parts[i]); err != nil {
+				continue
+			}
+			key[i] = parts[i]
+		}
+	}
+	return strings.Join(key, ".")
+}
 
 func (v Version) MajorMinor() string {
-	parts := versionSeparator.Split(string(v), 3)
+	parts := versionSeparator.Split(string(v.normalized()), 3)
 	if len(parts) < 2 {
 		return "0.0"
 	}
 	return parts[0] + "." + parts[1]
 }
 
+// Compare returns -1, 0 or 1 when v is respectively lower than, equal to or
+// higher than w. Components are compared numerically when both are numbers.
+// A missing component counts as 0, so 5.2 equals 5.2.0 and is lower than
+// 5.2.1. A non-numeric component, such as an EAP suffix, is lower than any
+// number, so 5.2.0-m01 comes before 5.2.0 (and 5.2).
+func (v Version) Compare(w Version) int {
+	a := versionSeparator.Split(string(v), -1)
+	b := versionSeparator.Split(string(w), -1)
+	for i := 0; i < len(a) || i < len(b); i++ {
+		x, y := "0", "0"
+		if i < len(a) {
+			x = a[i]
+		}
+		if i < len(b) {
+			y = b[i]
+		}
+		if c := compareComponent(x, y); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareComponent(a, b string) int {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	switch {
+	case errA != nil && errB != nil:
+		return strings.Compare(a, b)
+	case errA != nil:
+		return -1
+	case errB != nil:
+		return 1
+	}
+	return compareInt(x, y)
+}
+
+func compareInt(x, y int) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// feedLocation is the time zone the dates in the feeds are read in. The feeds
+// don't include one so this defaults to UTC; it is set from -feed-timezone.
+var feedLocation = time.UTC
+
+// AtlassianTime is a release date from the feeds. It is midnight of that day
+// in feedLocation, so dates read in the same run always compare consistently.
 type AtlassianTime time.Time
 
 func (a *AtlassianTime) UnmarshalJSON(data []byte) error {
@@ -170,7 +1470,7 @@ func (a *AtlassianTime) UnmarshalJSON(data []byte) error {
 	if err != nil {
 		return err
 	}
-	t, err := time.Parse("02-Jan-2006", str)
+	t, err := time.ParseInLocation("02-Jan-2006", str, feedLocation)
 	if err != nil {
 		return err
 	}
@@ -178,22 +1478,13 @@ func (a *AtlassianTime) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
-func copyFile(src, dst string, perm os.FileMode) (err error) {
-	in, err := os.Open(src)
-	if err != nil {
-		return err
-	}
-	defer in.Close()
-	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		oErr := out.Close()
-		if err == nil {
-			err = oErr
-		}
-	}()
-	_, err = io.Copy(out, in)
-	return err
+// String formats the date the way the feeds do, such as 14-Mar-2017.
+func (a AtlassianTime) String() string {
+	return time.Time(a).Format("02-Jan-2006")
+}
+
+// RFC3339 formats the date as an RFC 3339 time, midnight in feedLocation,
+// such as 2017-03-14T00:00:00Z.
+func (a AtlassianTime) RFC3339() string {
+	return time.Time(a).Format(time.RFC3339)
 }
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// feedFixture is a feed in the JSONP form the atlassian feeds are served in.
+const feedFixture = `downloads([
+{"zipUrl":"https://example.com/atlassian-crowd-2.11.1.tar.gz","version":"2.11.1","released":"01-Feb-2017"},
+{"zipUrl":"https://example.com/atlassian-crowd-2.12.0.tar.gz","version":"2.12.0","released":"01-Jun-2017"}
+])`
+
+// inTempRepo runs the rest of the test in a temporary copy of the repository
+// root holding just the templates and the entrypoint, with the version
+// directories dirs, each with a placeholder Dockerfile.
+func inTempRepo(t *testing.T, dirs ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, name := range []string{"Dockerfile.tmpl", "Dockerfile.multi.tmpl", "Makefile.tmpl", "docker-entrypoint.sh"} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range dirs {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, dir, "Dockerfile"), []byte("FROM scratch\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(root); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+	return root
+}
+
+// writeFeed writes body to a file in the current directory and returns its
+// file:// URL.
+func writeFeed(t *testing.T, name, body string) string {
+	t.Helper()
+	if err := os.WriteFile(name, []byte(body), 0644); err != nil {
+		t.Fatal(err)
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "file://" + filepath.ToSlash(abs)
+}
+
+// versionDirsIn lists the version directories under root.
+func versionDirsIn(t *testing.T, root string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dirs []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			dirs = append(dirs, entry.Name())
+		}
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// TestReconcile covers -create-new, -prune and -hold together: the feeds have
+// dropped 2.9 and 2.10 and added 2.12, and 2.10 is held.
+func TestReconcile(t *testing.T) {
+	root := inTempRepo(t, "2.9", "2.10", "2.11")
+	feed := writeFeed(t, "feed.json", feedFixture)
+	empty := writeFeed(t, "empty.json", "downloads([])")
+
+	cfg, err := parseConfig([]string{
+		"-archive-feed", feed, "-current-feed", empty, "-eap-feed", empty,
+		"-create-new", "-prune", "-hold", "2.10",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"2.10", "2.11", "2.12"}
+	if got := versionDirsIn(t, root); !reflect.DeepEqual(got, want) {
+		t.Errorf("version directories are %v, want %v", got, want)
+	}
+	held, err := os.ReadFile(filepath.Join(root, "2.10", "Dockerfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(held) != "FROM scratch\n" {
+		t.Errorf("held 2.10/Dockerfile was rewritten:\n%s", held)
+	}
+	for _, dir := range []string{"2.11", "2.12"} {
+		if v, _ := previousPackage(dir); v == "" {
+			t.Errorf("%s/Dockerfile wasn't generated", dir)
+		}
+	}
+}
+
+func TestUnwantedReason(t *testing.T) {
+	for _, tt := range []struct {
+		filename   string
+		includeWar bool
+		want       string
+	}{
+		{"atlassian-crowd-2.11.1.tar.gz", false, ""},
+		{"atlassian-crowd-enterprise-standalone-2.11.1.tar.gz", false, ""},
+		{"atlassian-crowd-standalone-2.11.1.tar.gz", false, ""},
+		{"atlassian-crowd-enterprise-2.11.1.tar.gz", false, "enterprise build that isn't standalone"},
+		{"atlassian-crowd-enterprise-cluster-2.11.1.tar.gz", false, "cluster build"},
+		{"atlassian-crowd-cluster-2.11.1.tar.gz", false, "cluster build"},
+		{"atlassian-crowd-2.11.1-war.zip", false, "war build"},
+		{"atlassian-crowd-2.11.1-war.zip", true, ""},
+		{"atlassian-crowd-2.11.1.zip", false, "not a tar.gz"},
+	} {
+		if got := unwantedReason(tt.filename, tt.includeWar); got != tt.want {
+			t.Errorf("unwantedReason(%q, %t) = %q, want %q", tt.filename, tt.includeWar, got, tt.want)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	for _, tt := range []struct {
+		v, w Version
+		want int
+	}{
+		{"2.11.1", "2.11.1", 0},
+		{"2.11", "2.11.0", 0},
+		{"2.11", "2.11.1", -1},
+		{"2.9", "2.10", -1},
+		{"2.10.0", "2.9.9", 1},
+		{"5.2.0-m01", "5.2.0", -1},
+		{"5.2.0-m01", "5.2", -1},
+		{"5.2.0-m02", "5.2.0-m01", 1},
+		{"3.0", "2.99", 1},
+	} {
+		if got := tt.v.Compare(tt.w); got != tt.want {
+			t.Errorf("%s.Compare(%s) = %d, want %d", tt.v, tt.w, got, tt.want)
+		}
+	}
+}
+
+func TestNormalized(t *testing.T) {
+	for _, tt := range []struct {
+		v, want Version
+	}{
+		{"5.1.0", "5.1.0"},
+		{"5-1-0", "5.1.0"},
+		{"5.2.0-m01", "5.2.0-m01"},
+		{"5-2-0-m01", "5.2.0-m01"},
+	} {
+		if got := tt.v.normalized(); got != tt.want {
+			t.Errorf("%s.normalized() = %s, want %s", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestLeading(t *testing.T) {
+	for _, tt := range []struct {
+		v    Version
+		n    int
+		want string
+	}{
+		{"5.1.3", 1, "5"},
+		{"5.1.3", 2, "5.1"},
+		{"5.1", 3, "5.1.0"},
+		{"5-1-3", 2, "5.1"},
+		{"5.2.0-m01", 3, "5.2.0"},
+		{"5.2-m01", 3, "5.2.0"},
+	} {
+		if got := tt.v.leading(tt.n); got != tt.want {
+			t.Errorf("%s.leading(%d) = %s, want %s", tt.v, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestNewerThan(t *testing.T) {
+	day := func(d int) AtlassianTime { return AtlassianTime(time.Date(2017, 3, d, 0, 0, 0, 0, time.UTC)) }
+	pkg := func(v Version, file string, released AtlassianTime) Package {
+		return Package{Version: v, ZipURL: "https://example.com/" + file, Released: released}
+	}
+	for _, tt := range []struct {
+		name string
+		p, q Package
+		want bool
+	}{
+		{"higher version", pkg("2.11.2", "a-2.11.2.tar.gz", day(1)), pkg("2.11.1", "a-2.11.1.tar.gz", day(2)), true},
+		{"lower version", pkg("2.11.1", "a-2.11.1.tar.gz", day(2)), pkg("2.11.2", "a-2.11.2.tar.gz", day(1)), false},
+		{"later release", pkg("2.11.1", "a-2.11.1.tar.gz", day(2)), pkg("2.11.1", "a-2.11.1.tar.gz", day(1)), true},
+		{"earlier release", pkg("2.11.1", "a-2.11.1.tar.gz", day(1)), pkg("2.11.1", "a-2.11.1.tar.gz", day(2)), false},
+		{"shorter filename", pkg("2.11.1", "a-2.11.1.tar.gz", day(1)), pkg("2.11.1", "a-x-2.11.1.tar.gz", day(2)), true},
+		{"longer filename", pkg("2.11.1", "a-x-2.11.1.tar.gz", day(2)), pkg("2.11.1", "a-2.11.1.tar.gz", day(1)), false},
+		{"first alphabetically", pkg("2.11.1", "a-2.11.1.tar.gz", day(1)), pkg("2.11.1", "b-2.11.1.tar.gz", day(2)), true},
+		{"same package", pkg("2.11.1", "a-2.11.1.tar.gz", day(1)), pkg("2.11.1", "a-2.11.1.tar.gz", day(1)), false},
+	} {
+		if got := tt.p.newerThan(tt.q); got != tt.want {
+			t.Errorf("%s: newerThan = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOnlyBuildDateDiffers(t *testing.T) {
+	tm := template.Must(template.New("Dockerfile.tmpl").Parse("FROM scratch\nENV CROWD_VERSION {{.Version}}\nLABEL created={{.BuildDate}}\nLABEL built={{.BuildDate}}\n"))
+	data := templateData{Package: Package{Version: "2.11.1"}, BuildDate: "2017-03-02"}
+	for _, tt := range []struct {
+		name, have string
+		want       bool
+	}{
+		{"other date", "FROM scratch\nENV CROWD_VERSION 2.11.1\nLABEL created=2017-03-01\nLABEL built=2017-03-01\n", true},
+		{"same date", "FROM scratch\nENV CROWD_VERSION 2.11.1\nLABEL created=2017-03-02\nLABEL built=2017-03-02\n", true},
+		{"two dates", "FROM scratch\nENV CROWD_VERSION 2.11.1\nLABEL created=2017-03-01\nLABEL built=2017-02-01\n", false},
+		{"other version", "FROM scratch\nENV CROWD_VERSION 2.11.0\nLABEL created=2017-03-01\nLABEL built=2017-03-01\n", false},
+		{"extra line", "FROM scratch\nENV CROWD_VERSION 2.11.1\nLABEL created=2017-03-01\nLABEL built=2017-03-01\nUSER crowd\n", false},
+	} {
+		if got := onlyBuildDateDiffers([]byte(tt.have), tm, data); got != tt.want {
+			t.Errorf("%s: onlyBuildDateDiffers = %t, want %t", tt.name, got, tt.want)
+		}
+	}
+
+	noDate := template.Must(template.New("Dockerfile.tmpl").Parse("FROM scratch\nENV CROWD_VERSION {{.Version}}\n"))
+	if onlyBuildDateDiffers([]byte("FROM scratch\nENV CROWD_VERSION 2.11.0\n"), noDate, data) {
+		t.Error("onlyBuildDateDiffers = true for a template without a build date")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// validate runs the -validate preflight checks, printing the outcome of each.
+// It writes nothing and fails if any of the checks do.
+func validate(ctx context.Context, cfg Config) error {
+	type check struct {
+		name string
+		fn   func() error
+	}
+	checks := []check{
+		{"Dockerfile.tmpl parses", func() error {
+			_, err := template.ParseFiles("Dockerfile.tmpl")
+			return err
+		}},
+		{"working directory is the repository root", func() error {
+			return checkRepoRoot(cfg)
+		}},
+	}
+	if !cfg.NoEntrypoint {
+		checks = append(checks, check{cfg.EntrypointSrc + " is usable", func() error {
+			if err := checkEntrypointSource(cfg.EntrypointSrc); err != nil {
+				return err
+			}
+			info, err := os.Stat(cfg.EntrypointSrc)
+			if err == nil && info.Size() == 0 {
+				err = fmt.Errorf("%s is empty", cfg.EntrypointSrc)
+			}
+			return err
+		}})
+	}
+	f := newFetcher(cfg)
+	for _, fd := range cfg.feeds() {
+		for _, url := range fd.URLs {
+			url := url
+			checks = append(checks, check{fd.Channel + " feed " + url + " is reachable", func() error {
+				return f.reachable(ctx, url)
+			}})
+		}
+	}
+
+	var failed int
+	for _, c := range checks {
+		if err := c.fn(); err != nil {
+			fmt.Printf("FAIL %s: %s\n", c.name, err)
+			failed++
+			continue
+		}
+		fmt.Printf("ok   %s\n", c.name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return nil
+}
+
+// checkRepoRoot makes sure the working directory has the files every run
+// needs, which is a good sign it is the root of the repository.
+func checkRepoRoot(cfg Config) error {
+	for _, name := range []string{"Dockerfile.tmpl", cfg.EntrypointSrc} {
+		if _, err := os.Stat(name); err != nil {
+			return fmt.Errorf("%s is missing", name)
+		}
+	}
+	return nil
+}
+
+// looksLikeRepoRoot guards a run against being started in the wrong
+// directory: the working directory has to have Dockerfile.tmpl and the
+// entrypoint, or at least one version directory with a Dockerfile in it.
+func looksLikeRepoRoot(cfg Config) error {
+	if checkRepoRoot(cfg) == nil {
+		return nil
+	}
+	dirs, err := getDirs(".")
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if isVersionDir(dir, cfg) && hasDockerfile(dir, cfg) {
+			return nil
+		}
+	}
+	wd, _ := os.Getwd()
+	return fmt.Errorf("%s doesn't look like the crowd repo root: it has neither Dockerfile.tmpl and %s nor a version directory with a Dockerfile; run from the root or pass -force", wd, cfg.EntrypointSrc)
+}
+
+// templateSamples are the synthetic packages -validate-template renders
+// Dockerfile.tmpl with, covering what the feeds can produce.
+var templateSamples = []struct {
+	name string
+	pkg  Package
+}{
+	{"latest release", Package{
+		ZipURL:   "https://www.atlassian.com/software/crowd/downloads/binary/atlassian-crowd-2.11.1.tar.gz",
+		Version:  "2.11.1",
+		Released: AtlassianTime(time.Date(2017, 3, 14, 0, 0, 0, 0, time.UTC)),
+		Latest:   true,
+		Channel:  channelCurrent,
+		Artifact: artifactStandalone,
+		SHA256:   strings.Repeat("0", 64),
+	}},
+	{"EAP release", Package{
+		ZipURL:   "https://www.atlassian.com/software/crowd/downloads/binary/atlassian-crowd-2.12.0-m01.tar.gz",
+		Version:  "2.12.0-m01",
+		Released: AtlassianTime(time.Date(2017, 4, 1, 0, 0, 0, 0, time.UTC)),
+		Channel:  channelEAP,
+		Artifact: artifactStandalone,
+	}},
+	{"minimal package", Package{
+		ZipURL:  "https://example.com/crowd.tar.gz",
+		Version: "1.0",
+	}},
+}
+
+// validateTemplate renders Dockerfile.tmpl with each of the templateSamples,
+// once per configured variant, and reports any that fail. Nothing is written.
+func validateTemplate(cfg Config) error {
+	var err error
+	if tmpl, err = template.ParseFiles("Dockerfile.tmpl"); err != nil {
+		return err
+	}
+	variants := cfg.Variants
+	if len(variants) == 0 {
+		variants = []Variant{{}}
+	}
+	var failed, total int
+	for _, s := range templateSamples {
+		for _, v := range variants {
+			name := s.name
+			if v.Name != "" {
+				name += " (" + v.Name + ")"
+			}
+			total++
+			if _, err := renderDockerfile(tmpl, newTemplateData(s.pkg, v, cfg)); err != nil {
+				fmt.Printf("FAIL %s: %s\n", name, err)
+				failed++
+				continue
+			}
+			fmt.Printf("ok   %s\n", name)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d renders failed", failed, total)
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Variant is one flavour of image built for every version, such as one per
+// JDK. Variants are only configured in the config file. Each one is written to
+// a subdirectory of the version directory named after it, and its fields are
+// available to the template alongside the package's.
+type Variant struct {
+	Name      string `json:"name"`
+	BaseImage string `json:"baseImage"`
+	JDK       string `json:"jdk"`
+}
+
+// templateData is what Dockerfile.tmpl is executed with. Without variants the
+// Variant fields are empty and the template falls back to its own defaults.
+type templateData struct {
+	Package
+	Variant
+	// Extra holds the -template-data pairs, so a template can use
+	// .Extra.proxy for -template-data proxy=http://proxy:3128.
+	Extra map[string]string
+	// BuildDate is -source-date, or the package's release date without it,
+	// so regenerating never changes it; and an existing Dockerfile that
+	// differs only in its build date is left alone.
+	BuildDate string
+	// Filename is the tarball's name as downloaded, such as
+	// atlassian-crowd-2.11.1.tar.gz, and NormalizedFilename a name that is
+	// the same for every version of the artifact type: crowd.tar.gz for
+	// standalone tarballs and crowd-war plus the download's extension for
+	// war builds.
+	Filename           string
+	NormalizedFilename string
+	// Entrypoint is the -entrypoint-dst name of the entrypoint script.
+	Entrypoint string
+	// ReleasedRFC3339 is the release date as an RFC 3339 time, for OCI
+	// labels; .Released still gives it as the feeds do.
+	ReleasedRFC3339 string
+}
+
+func newTemplateData(p Package, v Variant, cfg Config) templateData {
+	if v.BaseImage == "" {
+		v.BaseImage = cfg.BaseImage
+	}
+	if v.JDK == "" {
+		v.JDK = cfg.JDK
+	}
+	date := cfg.SourceDate
+	if date.IsZero() {
+		date = Timestamp(p.Released)
+	}
+	return templateData{
+		Package:            p,
+		Variant:            v,
+		Extra:              cfg.TemplateData,
+		BuildDate:          date.String(),
+		Filename:           path.Base(p.ZipURL),
+		NormalizedFilename: normalizedFilename(p),
+		Entrypoint:         cfg.EntrypointDst,
+		ReleasedRFC3339:    p.Released.RFC3339(),
+	}
+}
+
+// normalizedFilename names the download after its artifact type alone.
+func normalizedFilename(p Package) string {
+	name := path.Base(p.ZipURL)
+	ext := path.Ext(name)
+	if strings.HasSuffix(name, ".tar.gz") {
+		ext = ".tar.gz"
+	}
+	if p.Artifact == artifactWar {
+		return "crowd-war" + ext
+	}
+	return "crowd" + ext
+}
+
+// target is a directory update writes a Dockerfile and entrypoint into, for
+// the version directory with the major.minor key. The files are written to
+// out, which is dir itself unless -out-dir mirrors it elsewhere.
+type target struct {
+	dir  string
+	out  string
+	key  string
+	data templateData
+}
+
+// targets lists where update writes for a version directory: the directory
+// itself when there are no variants, otherwise a subdirectory per variant that
+// applies to the version. A variant applies unless the config's jdkMap lists
+// the JDKs for the version's major.minor and the variant's isn't one of them.
+func targets(e planEntry, cfg Config) []target {
+	dir, pkg := e.Dir, e.Package
+	if len(cfg.Variants) == 0 {
+		return []target{{dir: dir, out: filepath.Join(cfg.OutDir, dir), key: e.Key, data: newTemplateData(pkg, Variant{}, cfg)}}
+	}
+	jdks, limited := cfg.JDKMap[e.Key]
+	var ts []target
+	for _, v := range cfg.Variants {
+		if limited && v.JDK != "" && !contains(jdks, v.JDK) {
+			debugf("skipping variant %s for %s", v.Name, dir)
+			continue
+		}
+		ts = append(ts, target{
+			dir:  filepath.Join(dir, v.Name),
+			out:  filepath.Join(cfg.OutDir, dir, v.Name),
+			key:  e.Key,
+			data: newTemplateData(pkg, v, cfg),
+		})
+	}
+	return ts
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}